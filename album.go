@@ -0,0 +1,402 @@
+package musefuse
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// MissingFile is the name of the file in each ViewIncomplete album listing
+// the tracks that weren't found.
+const MissingFile = "MISSING.txt"
+
+// albumKey groups an album's entries by their MusicBrainz release ID alone,
+// so two releases with the same name stay apart and a release's tracks stay
+// together even if their tags don't agree on its artist or title, or failing
+// that by the nameKey of its artist and title, so differently spelt tags
+// still make one album.
+type albumKey struct {
+	release string
+	artist  string
+	album   string
+}
+
+// albumPlace is the artist and album directories an album is shown in.
+type albumPlace struct {
+	artist, album string
+}
+
+// albumGroup is every entry in an album, and the MissingFile placed for it in
+// ViewIncomplete. An album is complete when every track numbered up to Tracks
+// is present on every disc numbered up to Discs.
+type albumGroup struct {
+	key        albumKey
+	entries    map[string]*FileEntry
+	missing    *textNode
+	missingDir *dirNode
+
+	// name is the artist and title of the album's first entry, with no
+	// release, if named is set; see albumNames. place is where the album is
+	// shown, taken from the same entry.
+	name  albumKey
+	named bool
+	place albumPlace
+
+	// view and path are where the album was placed, if it was, and placed
+	// contains the keys of the entries placed there; see placeAlbum.
+	view   string
+	path   []string
+	placed map[string]bool
+}
+
+// albumArtist returns the artist an entry's album is grouped under.
+func albumArtist(meta *Metadata) string {
+	if meta.AlbumArtist != "" {
+		return meta.AlbumArtist
+	}
+	return meta.Artist
+}
+
+// albumKeyOf must be called with fs.lock held.
+func (fs *FS) albumKeyOf(entry *FileEntry) (key albumKey, ok bool) {
+	meta := entry.Metadata
+	if entry.Err != "" || meta == nil || meta.Album == "" || albumArtist(meta) == "" {
+		return key, false
+	}
+	if key.release = meta.MusicBrainz.Release; key.release != "" {
+		return key, true
+	}
+	return fs.albumNameOf(entry), true
+}
+
+// albumNameOf returns the key of the artist and title of entry's album, with
+// no release. It must be called with fs.lock held.
+func (fs *FS) albumNameOf(entry *FileEntry) albumKey {
+	return albumKey{
+		artist: fs.names.key(nameArtist, albumArtist(entry.Metadata)),
+		album:  fs.names.key(nameAlbum, entry.Metadata.Album),
+	}
+}
+
+// albumView returns entry as it is rendered in the template views: with the
+// artist and title of its album replaced by where the album is shown, so all
+// of a release's tracks end up in the same directory, and releases that share
+// a name are kept apart as they are in ViewComplete. It must be called with
+// fs.lock held.
+func (fs *FS) albumView(entry *FileEntry) (view *FileEntry, place albumPlace, ok bool) {
+	key, ok := fs.albumKeyOf(entry)
+	if !ok || fs.albums[key] == nil {
+		return entry, place, false
+	}
+	place = fs.albums[key].place
+	meta := *entry.Metadata
+	meta.Album = place.album
+	if key.release != "" {
+		meta.AlbumArtist = place.artist
+	}
+	return &FileEntry{File: entry.File, Metadata: &meta}, place, true
+}
+
+// addToAlbum must be called with fs.lock held.
+func (fs *FS) addToAlbum(entry *FileEntry) error {
+	key, ok := fs.albumKeyOf(entry)
+	if !ok {
+		return nil
+	}
+	group := fs.albums[key]
+	if group == nil {
+		group = &albumGroup{key: key, entries: map[string]*FileEntry{}}
+		fs.albums[key] = group
+	}
+	group.entries[entry.File.FullPath()] = entry
+	return fs.placeAlbum(group)
+}
+
+// nameAlbum moves group to the albumNames for first, the entry it is named
+// after, if it isn't there already. The album groups that did or now do share
+// its name are placed again, as whether they share the name changes their
+// paths. It must be called with fs.lock held.
+func (fs *FS) nameAlbum(group *albumGroup, first *FileEntry) error {
+	name := fs.albumNameOf(first)
+	if group.named && group.name == name {
+		return nil
+	}
+	fs.unnameAlbum(group)
+	group.name, group.named = name, true
+	fs.albumNames[name] = append(fs.albumNames[name], group)
+	fs.movedAlbums[name] = true
+	return fs.placeAlbumNames(name, group)
+}
+
+// unnameAlbum removes group from albumNames, placing the album groups left
+// with its name again. It must be called with fs.lock held.
+func (fs *FS) unnameAlbum(group *albumGroup) {
+	if !group.named {
+		return
+	}
+	name := group.name
+	groups := fs.albumNames[name]
+	for i := range groups {
+		if groups[i] == group {
+			groups = append(groups[:i], groups[i+1:]...)
+			break
+		}
+	}
+	if len(groups) == 0 {
+		delete(fs.albumNames, name)
+	} else {
+		fs.albumNames[name] = groups
+	}
+	group.name, group.named = albumKey{}, false
+	fs.movedAlbums[name] = true
+
+	// The groups left were placed before, so they can be placed again:
+	_ = fs.placeAlbumNames(name, nil)
+}
+
+// placeAlbumNames places every album group called name, other than except,
+// again. It must be called with fs.lock held.
+func (fs *FS) placeAlbumNames(name albumKey, except *albumGroup) error {
+	for _, group := range fs.albumNames[name] {
+		if group != except {
+			if err := fs.placeAlbum(group); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeFromAlbum must be called with fs.lock held.
+func (fs *FS) removeFromAlbum(entry *FileEntry) {
+	key, ok := fs.albumKeyOf(entry)
+	if !ok {
+		return
+	}
+	group := fs.albums[key]
+	if group == nil {
+		return
+	}
+	delete(group.entries, entry.File.FullPath())
+	delete(group.placed, entry.File.FullPath())
+	if len(group.entries) == 0 {
+		fs.unplaceAlbum(group)
+		delete(fs.albums, key)
+		fs.unnameAlbum(group)
+		return
+	}
+
+	// The remaining entries can be placed where they were before, so this
+	// can't fail:
+	_ = fs.placeAlbum(group)
+}
+
+// replaceMovedAlbums places the entries of every album that has moved since
+// they were placed in the template views again. It must be called with
+// fs.lock held.
+func (fs *FS) replaceMovedAlbums() error {
+	for len(fs.movedAlbums) > 0 {
+		var keys []string
+		for name := range fs.movedAlbums {
+			for _, group := range fs.albumNames[name] {
+				for key := range group.entries {
+					if place, ok := fs.albumPlaces[key]; ok && place != group.place {
+						keys = append(keys, key)
+					}
+				}
+			}
+		}
+		fs.movedAlbums = map[albumKey]bool{}
+		sort.Strings(keys)
+		if err := fs.replaceAudio(keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FS) unplaceAlbum(group *albumGroup) {
+	fs.unplaceMissing(group)
+	group.view, group.path, group.placed = "", nil, nil
+
+	// Forget the nodes before removing them, as removing one may rename
+	// (and so replace) some of the others:
+	var remove []*fileNode
+	for key := range group.entries {
+		var keep []*fileNode
+		for _, file := range fs.nodes[key] {
+			if file.view == ViewComplete || file.view == ViewIncomplete {
+				remove = append(remove, file)
+			} else {
+				keep = append(keep, file)
+			}
+		}
+		fs.nodes[key] = keep
+	}
+	fs.removeNodes(remove)
+}
+
+// placeAlbum places the entries in group that haven't been placed yet in
+// ViewComplete or ViewIncomplete, and replaces the album's MissingFile. If
+// that moves the album, as one file being added or removed can, every node
+// previously placed for it is removed and placed again. The album is shown
+// with the artist and title of its first entry; if other releases share them,
+// the start of its release ID is added to the title to keep them apart. If
+// that changes, the album is added to movedAlbums, as its entries also need
+// placing again in the template views; see replaceMovedAlbums.
+func (fs *FS) placeAlbum(group *albumGroup) error {
+	entries := make([]*FileEntry, 0, len(group.entries))
+	for _, entry := range group.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return fileLess(entries[i].File, entries[j].File)
+	})
+
+	if err := fs.nameAlbum(group, entries[0]); err != nil {
+		return err
+	}
+	meta := entries[0].Metadata
+	place := albumPlace{
+		artist: fs.names.display(nameArtist, albumArtist(meta)),
+		album:  fs.names.display(nameAlbum, meta.Album),
+	}
+	if release := group.key.release; release != "" && len(fs.albumNames[group.name]) > 1 {
+		if len(release) > 8 {
+			release = release[:8]
+		}
+		place.album += " [" + release + "]"
+	}
+	if place != group.place {
+		group.place = place
+		fs.movedAlbums[group.name] = true
+	}
+
+	missing, known := albumMissing(entries)
+	if !known {
+		fs.unplaceAlbum(group)
+		return nil
+	}
+	view := ViewComplete
+	if len(missing) > 0 {
+		view = ViewIncomplete
+	}
+	path := []string{view, place.artist, place.album}
+
+	if view != group.view || !stringsEqual(path, group.path) {
+		fs.unplaceAlbum(group)
+		group.view, group.path, group.placed = view, path, map[string]bool{}
+	}
+
+	for _, entry := range entries {
+		key := entry.File.FullPath()
+		if group.placed[key] {
+			continue
+		}
+		group.placed[key] = true
+		if !fs.hasView(entry, view) {
+			continue
+		}
+		name := entry.Metadata.Title
+		if track := formatTrack(entry.Metadata); track != "" {
+			name = track + " " + name
+		}
+		if _, err := fs.addNode(view, name, entry, path...); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, track := range missing {
+		fmt.Fprintln(&buf, track)
+	}
+	if group.missing != nil && bytes.Equal(group.missing.data, buf.Bytes()) {
+		return nil
+	}
+	fs.unplaceMissing(group)
+	dir := fs.findDir(path...)
+	if len(missing) > 0 && dir != nil {
+		if _, ok := dir.index[MissingFile]; !ok {
+			group.missing = &textNode{inode: fs.inode(dir.childPath(MissingFile), nil), name: MissingFile, data: buf.Bytes()}
+			group.missingDir = dir
+			dir.addText(group.missing)
+			fs.pending = append(fs.pending, invalidation{dir, MissingFile})
+		}
+	}
+	return nil
+}
+
+// unplaceMissing removes the MissingFile placed for group, if any, pruning
+// the album's directory if nothing else is left in it.
+func (fs *FS) unplaceMissing(group *albumGroup) {
+	if group.missing == nil {
+		return
+	}
+	dir := group.missingDir
+	dir.removeText(group.missing)
+	fs.pending = append(fs.pending, invalidation{dir, group.missing.name})
+	fs.prune(dir)
+	group.missing, group.missingDir = nil, nil
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// albumMissing returns the tracks missing from entries, formatted as per
+// formatTrack, or "disc N" if a whole disc is missing. known is false if the
+// tags don't say how many tracks there should be.
+func albumMissing(entries []*FileEntry) (missing []string, known bool) {
+	discs := 0
+	tracks := map[int]int{}
+	have := map[int]map[int]bool{}
+
+	for _, entry := range entries {
+		meta := entry.Metadata
+		if meta.Track <= 0 {
+			return nil, false
+		}
+		disc := meta.Disc
+		if disc <= 0 {
+			disc = 1
+		}
+		if meta.Discs > discs {
+			discs = meta.Discs
+		}
+		if disc > discs {
+			discs = disc
+		}
+		if meta.Tracks > tracks[disc] {
+			tracks[disc] = meta.Tracks
+		}
+		if have[disc] == nil {
+			have[disc] = map[int]bool{}
+		}
+		have[disc][meta.Track] = true
+	}
+
+	for disc := 1; disc <= discs; disc++ {
+		if have[disc] == nil {
+			missing = append(missing, fmt.Sprintf("disc %d", disc))
+			continue
+		} else if tracks[disc] <= 0 {
+			return nil, false
+		}
+		for track := 1; track <= tracks[disc]; track++ {
+			if have[disc][track] {
+				continue
+			}
+			meta := &Metadata{Disc: disc, Discs: discs, Track: track}
+			missing = append(missing, formatTrack(meta))
+		}
+	}
+	return missing, true
+}
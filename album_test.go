@@ -0,0 +1,133 @@
+package musefuse
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestFSCompleteAlbums(t *testing.T) {
+	fs := NewFS()
+	add := func(disc, discs, track, tracks int) *FileEntry {
+		e := testEntry(fmt.Sprintf("%d-%d.mp3", disc, track), &Metadata{
+			AlbumArtist: "Foo", Artist: "Foo", Album: "X", Title: fmt.Sprint("T", track),
+			Disc: disc, Discs: discs, Track: track, Tracks: tracks,
+		})
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	add(1, 2, 1, 2)
+	last := add(1, 2, 2, 2)
+	add(2, 2, 2, 3)
+
+	missing, ok := fs.lookup("incomplete/Foo/X/" + MissingFile).(*textNode)
+	if !ok {
+		t.Fatal("expected missing file")
+	}
+	bts, _ := missing.ReadAll(context.Background())
+	if string(bts) != "02-01\n02-03\n" {
+		t.Fatalf("unexpected missing tracks %q", bts)
+	}
+	if fs.lookup("incomplete/Foo/X/01-01 T1.mp3") == nil {
+		t.Fatal("expected track in incomplete")
+	}
+
+	// Adding a track leaves the others where they are:
+	first := fs.lookup("incomplete/Foo/X/01-01 T1.mp3")
+	add(2, 2, 1, 3)
+	if fs.lookup("incomplete/Foo/X/01-01 T1.mp3") != first {
+		t.Fatal("expected track to stay put")
+	}
+	bts, _ = fs.lookup("incomplete/Foo/X/" + MissingFile).(*textNode).ReadAll(context.Background())
+	if string(bts) != "02-03\n" {
+		t.Fatalf("unexpected missing tracks %q", bts)
+	}
+
+	add(2, 2, 3, 3)
+	if fs.lookup("incomplete") != nil {
+		t.Fatal("expected incomplete to be pruned")
+	}
+	if n := len(fs.lookup("complete/Foo/X").(*dirNode).dirents()); n != 5 {
+		t.Fatal("expected 5 tracks in complete album, found", n)
+	}
+
+	fs.RemoveAudio(last.File.FullPath())
+	if fs.lookup("complete") != nil {
+		t.Fatal("expected complete to be pruned")
+	}
+	if fs.lookup("incomplete/Foo/X/"+MissingFile) == nil {
+		t.Fatal("expected album to be incomplete again")
+	}
+}
+
+func TestAlbumMissing(t *testing.T) {
+	entry := func(disc, discs, track, tracks int) *FileEntry {
+		return testEntry("", &Metadata{Disc: disc, Discs: discs, Track: track, Tracks: tracks})
+	}
+
+	missing, known := albumMissing([]*FileEntry{entry(0, 0, 1, 0)})
+	if known {
+		t.Fatal("expected unknown without Tracks", missing)
+	}
+
+	missing, known = albumMissing([]*FileEntry{entry(1, 2, 1, 1)})
+	if !known || len(missing) != 1 || missing[0] != "disc 2" {
+		t.Fatal("expected missing disc", missing, known)
+	}
+
+	missing, known = albumMissing([]*FileEntry{entry(0, 0, 1, 3), entry(0, 0, 3, 3)})
+	if !known || len(missing) != 1 || missing[0] != "02" {
+		t.Fatal("expected missing track", missing, known)
+	}
+}
+
+func TestFSAlbumsByRelease(t *testing.T) {
+	const release1, release2 = "aaaaaaaa-0000-0000-0000-000000000001", "bbbbbbbb-0000-0000-0000-000000000002"
+	fs := NewFS()
+	add := func(path, release, artist, album string, track int) *FileEntry {
+		e := testEntry(path, &Metadata{
+			Artist: artist, Album: album, Title: fmt.Sprint("T", track), Track: track, Tracks: 2,
+			MusicBrainz: MusicBrainzIDs{Release: release},
+		})
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	first := add("a1.mp3", release1, "Foo", "X", 1)
+	add("a2.mp3", release1, "Foo feat. Bar", "X (Remaster)", 2)
+	for _, path := range []string{"complete/Foo/X/02 T2.mp3", "artistalbum/Foo/X/02 T2.mp3"} {
+		if fs.lookup(path) == nil {
+			t.Fatal("expected release to stay together despite its tags", path)
+		}
+	}
+
+	add("b1.mp3", release2, "Foo", "X", 1)
+	for _, path := range []string{
+		"complete/Foo/X [aaaaaaaa]/02 T2.mp3", "incomplete/Foo/X [bbbbbbbb]/01 T1.mp3",
+		"artistalbum/Foo/X [aaaaaaaa]/01 T1.mp3", "artistalbum/Foo/X [aaaaaaaa]/02 T2.mp3",
+		"artistalbum/Foo/X [bbbbbbbb]/01 T1.mp3", "mbid/" + release2 + "/01 T1.mp3",
+	} {
+		if fs.lookup(path) == nil {
+			t.Fatal("expected file", path)
+		}
+	}
+	if fs.lookup("artistalbum/Foo/X") != nil {
+		t.Fatal("expected releases to be kept apart in artistalbum")
+	}
+
+	// The release is now named after its second track:
+	fs.RemoveAudio(first.File.FullPath())
+	for _, path := range []string{"incomplete/Foo feat. Bar/X (Remaster)/02 T2.mp3", "artistalbum/Foo feat. Bar/X (Remaster)/02 T2.mp3", "artistalbum/Foo/X/01 T1.mp3"} {
+		if fs.lookup(path) == nil {
+			t.Fatal("expected file", path)
+		}
+	}
+	if fs.lookup("artistalbum/Foo/X [bbbbbbbb]") != nil || fs.lookup("complete") != nil {
+		t.Fatal("expected remaining releases without release in name")
+	}
+}
@@ -1,31 +1,42 @@
 package main
 
 import (
+	"expvar"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"github.com/davecgh/go-spew/spew"
-	"github.com/dhowden/tag"
 	"github.com/shabbyrobe/cmdy"
 	"github.com/shabbyrobe/cmdy/args"
 	"github.com/shabbyrobe/cmdy/flags"
 	service "github.com/shabbyrobe/go-service"
 	"github.com/shabbyrobe/go-service/services"
 	"github.com/shabbyrobe/musefuse"
-	"github.com/shabbyrobe/musefuse/playlist"
 )
 
 type fsCommand struct {
-	paths flags.StringList
-	mount string
-	web   string
-	name  string
+	paths   flags.StringList
+	mount   string
+	web     string
+	name    string
+	index   string
+	watch   bool
+	poll    time.Duration
+	workers int
+	config  string
+	aliases string
+
+	symlinks   flags.StringList
+	delimiters flags.StringList
+
+	flags *cmdy.FlagSet
 }
 
 func (cmd *fsCommand) Synopsis() string { return "FS" }
@@ -41,54 +52,192 @@ func (cmd *fsCommand) Flags() *cmdy.FlagSet {
 	set.StringVar(&cmd.mount, "mount", "", "Mount point")
 	set.StringVar(&cmd.name, "name", "MuseFUSE", "Name")
 	set.StringVar(&cmd.web, "web", "localhost:60608", "42. Web server, lets you browse the metadata..")
+	set.StringVar(&cmd.index, "index", defaultIndexPath(), "Metadata index location, skips re-parsing unchanged files on remount. Pass an empty string to disable.")
+	set.BoolVar(&cmd.watch, "watch", true, "Watch -path for changes and update the mounted tree")
+	set.DurationVar(&cmd.poll, "poll", 5*time.Minute, "If -watch can't use filesystem notifications, rescan this often instead")
+	set.IntVar(&cmd.workers, "workers", runtime.NumCPU()*2, "Number of files to parse tags from concurrently")
+	set.Var(&cmd.symlinks, "symlink", "Present the files in this view as symlinks to the source files instead of proxying reads; '*' for every view (can pass multiple times)")
+	set.Var(&cmd.delimiters, "delimiter", "Split artist and genre tags on this, e.g. ';'. Replaces the defaults; pass '' to not split at all (can pass multiple times)")
+	set.StringVar(&cmd.aliases, "aliases", "", "JSON file of artist and genre aliases, e.g. {\"artist\": {\"The Beatles\": [\"Fab Four\"]}}")
+	set.StringVar(&cmd.config, "config", "", "JSON config file. Flags passed explicitly take precedence over the file")
+	cmd.flags = set
 	return set
 }
 
+// applyConfig copies settings from the config file into any flag that was not
+// passed explicitly, and returns the databases to search and any extra views.
+func (cmd *fsCommand) applyConfig() (dbs []musefuse.DatabaseConfig, views []musefuse.ViewConfig, err error) {
+	passed := map[string]bool{}
+	cmd.flags.Visit(func(f *flag.Flag) { passed[f.Name] = true })
+
+	if cmd.config != "" {
+		config, err := musefuse.LoadConfig(cmd.config)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if config.Mount != "" && !passed["mount"] {
+			cmd.mount = config.Mount
+		}
+		if config.Name != "" && !passed["name"] {
+			cmd.name = config.Name
+		}
+		if config.Web != nil && !passed["web"] {
+			cmd.web = *config.Web
+		}
+		if config.Index != nil && !passed["index"] {
+			cmd.index = *config.Index
+		}
+		if config.Watch != nil && !passed["watch"] {
+			cmd.watch = *config.Watch
+		}
+		if config.PollInterval > 0 && !passed["poll"] {
+			cmd.poll = config.PollInterval
+		}
+		if config.Workers > 0 && !passed["workers"] {
+			cmd.workers = config.Workers
+		}
+		if len(config.Symlinks) > 0 && !passed["symlink"] {
+			cmd.symlinks = config.Symlinks
+		}
+		if config.Aliases != "" && !passed["aliases"] {
+			cmd.aliases = config.Aliases
+		}
+		if config.TagDelimiters != nil && !passed["delimiter"] {
+			cmd.delimiters = config.TagDelimiters
+		}
+		dbs = config.Databases
+		views = config.Views
+	}
+
+	// -path replaces the databases from the config file entirely:
+	if len(cmd.paths) > 0 {
+		dbs = []musefuse.DatabaseConfig{{Name: "default", Paths: cmd.paths}}
+	}
+
+	return dbs, views, nil
+}
+
 func (cmd *fsCommand) startWeb(ctx cmdy.Context, fs *musefuse.FS) error {
 	ws := musefuse.NewWebServer(cmd.web, fs)
 	return services.Start(ctx, service.New("", ws))
 }
 
 func (cmd *fsCommand) Run(ctx cmdy.Context) error {
-	if len(cmd.paths) == 0 {
-		return fmt.Errorf("musefuse: no -path supplied")
+	dbConfigs, viewConfigs, err := cmd.applyConfig()
+	if err != nil {
+		return err
+	}
+
+	if len(dbConfigs) == 0 {
+		return fmt.Errorf("musefuse: no -path supplied, and no databases found in -config")
 	}
 
 	if cmd.mount == "" {
 		return fmt.Errorf("musefuse: -mount is required")
 	}
 
-	lister := musefuse.NewLister(cmd.paths, musefuse.AudioExtensions, musefuse.PlaylistExtensions)
+	dbs := make([]musefuse.Database, len(dbConfigs))
+	for i, dbConfig := range dbConfigs {
+		dbs[i] = dbConfig.Database()
+	}
+	lister, err := musefuse.NewDatabaseLister(dbs)
+	if err != nil {
+		return err
+	}
+
+	var index *musefuse.Index
+	if cmd.index != "" {
+		index, err = musefuse.OpenIndex(cmd.index)
+		if err != nil {
+			return err
+		}
+	}
 
-	files, err := lister.List(nil)
+	views, err := musefuse.BuildViews(viewConfigs)
 	if err != nil {
 		return err
 	}
 
 	museFS := musefuse.NewFS()
-
-	scratch := make([]byte, 65536)
-	start := time.Now()
-	for _, file := range files {
-		if file.Kind != musefuse.FileAudio {
-			continue
+	if cmd.aliases != "" {
+		aliases, err := musefuse.LoadAliases(cmd.aliases)
+		if err != nil {
+			return err
 		}
+		museFS.SetAliases(aliases)
+	}
+	museFS.SetViews(views)
+	museFS.SetSymlinkViews(cmd.symlinks)
+	if cmd.delimiters != nil {
+		museFS.SetTagDelimiters(cmd.delimiters)
+	}
+	for _, dbConfig := range dbConfigs {
+		if len(dbConfig.Views) > 0 {
+			museFS.SetDatabaseViews(dbConfig.Name, dbConfig.Views)
+		}
+		museFS.SetDatabasePaths(dbConfig.Name, dbConfig.Paths)
+	}
 
-		path := filepath.Join(file.Prefix, file.Path)
-
-		tag, err := parseTag(path, scratch)
-		entry := &musefuse.FileEntry{
-			File:     file,
-			Metadata: musefuse.MetadataFromTag(tag),
+	loadEntry := func(file musefuse.FileInfo) *musefuse.FileEntry {
+		var entry *musefuse.FileEntry
+		if index != nil {
+			entry = index.Lookup(file)
 		}
-		if err != nil {
-			fmt.Printf("ERR %s %v\n", path, err)
-			entry.Err = err.Error()
+
+		if entry == nil {
+			path := filepath.Join(file.Prefix, file.Path)
+			meta, err := readMetadata(path)
+			entry = &musefuse.FileEntry{
+				File:     file,
+				Metadata: meta,
+			}
+			if err != nil {
+				fmt.Printf("ERR %s %v\n", path, err)
+				entry.Err = err.Error()
+			}
+			if index != nil {
+				index.Put(entry)
+			}
 		}
+		return entry
+	}
 
+	scanner := musefuse.NewScanner(loadEntry)
+	scanner.Workers = cmd.workers
+	expvar.Publish("scan", expvar.Func(func() interface{} { return scanner.Progress.Stats() }))
+
+	start := time.Now()
+	scanDone := make(chan struct{})
+	go reportProgress(scanner.Progress, scanDone)
+
+	files, err := scanner.ScanLister(lister, func(entry *musefuse.FileEntry) error {
 		if err := museFS.AddAudio(entry); err != nil {
-			fmt.Printf("ERR %s %v\n", path, err)
-			entry.Err = err.Error() // FIXME: maybe a race?
+			fmt.Printf("ERR %s %v\n", entry.File.FullPath(), err)
+
+			// entry belongs to the FS now, and FUSE requests may be reading
+			// it, so the error goes on a copy that replaces it in failed/:
+			failed := *entry
+			failed.Err = err.Error()
+			if err := museFS.UpdateAudio(&failed); err != nil {
+				fmt.Printf("ERR %s %v\n", entry.File.FullPath(), err)
+			}
+		}
+		return nil
+	})
+	close(scanDone)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, scanner.Progress.Stats())
+
+	if index != nil {
+		index.Retain(files)
+	}
+
+	for _, file := range files {
+		if file.Kind == musefuse.FileSidecar {
+			museFS.AddSidecar(file)
 		}
 	}
 
@@ -98,18 +247,23 @@ func (cmd *fsCommand) Run(ctx cmdy.Context) error {
 			continue
 		}
 
-		path := filepath.Join(file.Prefix, file.Path)
-
-		playlist, err := playlist.LoadPlaylistFile(path)
-		if err != nil {
-			return err
+		if err := museFS.AddPlaylist(file); err != nil {
+			fmt.Printf("ERR %s %v\n", file.FullPath(), err)
 		}
-
-		spew.Dump(playlist.Files())
 	}
 
 	dur := time.Since(start)
-	fmt.Println(dur, len(files), dur/time.Duration(len(files)))
+	var perFile time.Duration
+	if len(files) > 0 {
+		perFile = dur / time.Duration(len(files))
+	}
+	fmt.Println(dur, len(files), perFile)
+
+	if index != nil {
+		if err := index.Save(); err != nil {
+			return err
+		}
+	}
 
 	if cmd.web != "" {
 		if err := cmd.startWeb(ctx, museFS); err != nil {
@@ -151,13 +305,25 @@ func (cmd *fsCommand) Run(ctx cmdy.Context) error {
 	defer mountedFS.Close()
 	defer fuse.Unmount(cmd.mount)
 
+	server := fs.New(mountedFS, nil)
+	museFS.SetInvalidator(server)
+
 	errc := make(chan error, 1)
 	go func() {
-		if err := fs.Serve(mountedFS, museFS); err != nil {
+		if err := server.Serve(museFS); err != nil {
 			errc <- err
 		}
 	}()
 
+	if cmd.watch {
+		watcher := musefuse.NewWatcher(lister, museFS, files, loadEntry)
+		watcher.Index = index
+		watcher.PollInterval = cmd.poll
+		if err := services.Start(ctx, service.New("", watcher)); err != nil {
+			return err
+		}
+	}
+
 	select {
 	case <-mountedFS.Ready:
 	case err := <-errc:
@@ -168,6 +334,7 @@ func (cmd *fsCommand) Run(ctx cmdy.Context) error {
 		break
 	}
 
+wait:
 	for {
 		select {
 		case err := <-errc:
@@ -175,7 +342,7 @@ func (cmd *fsCommand) Run(ctx cmdy.Context) error {
 		case <-stop:
 			return fmt.Errorf("stopped")
 		case <-ctx.Done():
-			break
+			break wait
 		}
 	}
 
@@ -186,17 +353,33 @@ func (cmd *fsCommand) Run(ctx cmdy.Context) error {
 	return nil
 }
 
-func parseTag(path string, scratch []byte) (tag.Metadata, error) {
-	f, err := os.Open(path)
+func reportProgress(progress *musefuse.ScanProgress, done <-chan struct{}) {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			fmt.Fprintln(os.Stderr, progress.Stats())
+		}
+	}
+}
+
+func defaultIndexPath() string {
+	dir, err := os.UserCacheDir()
 	if err != nil {
-		return nil, err
+		return ""
 	}
-	defer f.Close()
+	return filepath.Join(dir, "musefuse", "index.json.gz")
+}
 
-	meta, err := tag.ReadFrom(f)
+func readMetadata(path string) (*musefuse.Metadata, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
-	return meta, nil
+	return musefuse.ReadMetadata(f)
 }
@@ -0,0 +1,371 @@
+package musefuse
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the contents of a musefuse config file, which is JSON:
+//
+//	{
+//	  "mount": "/media/me/muse",
+//	  "databases": [
+//	    {
+//	      "name": "music",
+//	      "paths": ["/home/me/music"],
+//	      "audioExtensions": [".mp3", ".flac"],
+//	      "ignore": ["Incoming", "*.part"],
+//	      "views": ["artistalbum", "decade", "failed"]
+//	    }
+//	  ],
+//	  "symlinks": ["failed"],
+//	  "tagDelimiters": [";", " feat. "],
+//	  "aliases": "aliases.json",
+//	  "views": [
+//	    {"name": "decade", "path": "decade/{{decade .Year}}/{{require .Album}}/{{track .}} {{.Title}}"}
+//	  ]
+//	}
+//
+// Every field is optional. Relative paths are relative to the directory
+// containing the config file.
+type Config struct {
+	Mount     string           `json:"mount"`
+	Name      string           `json:"name"`
+	Web       *string          `json:"web"`
+	Index     *string          `json:"index"`
+	Watch     *bool            `json:"watch"`
+	Poll      string           `json:"poll"`
+	Workers   int              `json:"workers"`
+	Databases []DatabaseConfig `json:"databases"`
+
+	// Views adds to, or replaces, DefaultViews. See ViewConfig.
+	Views []ViewConfig `json:"views"`
+
+	// Symlinks lists the views whose files are symlinks to the source files
+	// instead of proxied copies. "*" means every view, "query" means the
+	// results in the query directory.
+	Symlinks []string `json:"symlinks"`
+
+	// TagDelimiters split artist and genre tags into several values. If
+	// nil, DefaultTagDelimiters are used.
+	TagDelimiters []string `json:"tagDelimiters"`
+
+	// Aliases is the path to an alias file; see LoadAliases.
+	Aliases string `json:"aliases"`
+
+	// PollInterval is parsed from Poll.
+	PollInterval time.Duration `json:"-"`
+}
+
+type DatabaseConfig struct {
+	Name               string   `json:"name"`
+	Paths              []string `json:"paths"`
+	AudioExtensions    []string `json:"audioExtensions"`
+	PlaylistExtensions []string `json:"playlistExtensions"`
+	SidecarExtensions  []string `json:"sidecarExtensions"`
+	Ignore             []string `json:"ignore"`
+
+	// Views lists the names of the views the database's files appear in. If
+	// empty, they appear in all of them.
+	Views []string `json:"views"`
+}
+
+// Database converts the config into a Database, filling in the default
+// extensions if none were given.
+func (dc DatabaseConfig) Database() Database {
+	db := Database{
+		Name:               dc.Name,
+		Paths:              dc.Paths,
+		AudioExtensions:    dc.AudioExtensions,
+		PlaylistExtensions: dc.PlaylistExtensions,
+		SidecarExtensions:  dc.SidecarExtensions,
+		Ignore:             dc.Ignore,
+	}
+	if db.AudioExtensions == nil {
+		db.AudioExtensions = AudioExtensions
+	}
+	if db.PlaylistExtensions == nil {
+		db.PlaylistExtensions = PlaylistExtensions
+	}
+	if db.SidecarExtensions == nil {
+		db.SidecarExtensions = SidecarExtensions
+	}
+	return db
+}
+
+// ConfigError describes a problem with a config file, and where to find it.
+type ConfigError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (err *ConfigError) Error() string {
+	if err.Line > 0 {
+		return fmt.Sprintf("musefuse: config %s:%d: %s", err.File, err.Line, err.Msg)
+	}
+	return fmt.Sprintf("musefuse: config %s: %s", err.File, err.Msg)
+}
+
+var configKeys = map[string]bool{
+	"mount": true, "name": true, "web": true, "index": true, "watch": true,
+	"poll": true, "workers": true, "databases": true, "views": true,
+	"symlinks": true, "tagDelimiters": true, "aliases": true,
+}
+
+var viewConfigKeys = map[string]bool{"name": true, "path": true, "cover": true, "sidecars": true, "each": true}
+
+var databaseConfigKeys = map[string]bool{
+	"name": true, "paths": true, "audioExtensions": true, "playlistExtensions": true,
+	"sidecarExtensions": true, "ignore": true, "views": true,
+}
+
+func LoadConfig(file string) (*Config, error) {
+	bts, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(file, bts)
+}
+
+// ParseConfig parses and validates the config in bts. file is used to resolve
+// relative paths, and to report errors.
+func ParseConfig(file string, bts []byte) (*Config, error) {
+	fail := func(line int, msg string, args ...interface{}) error {
+		return &ConfigError{File: file, Line: line, Msg: fmt.Sprintf(msg, args...)}
+	}
+
+	var config Config
+	if err := json.Unmarshal(bts, &config); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) {
+			return nil, fail(lineAt(bts, syntaxErr.Offset), "%v", err)
+		} else if errors.As(err, &typeErr) {
+			return nil, fail(lineAt(bts, typeErr.Offset), "%q should be %s, found %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return nil, fail(0, "%v", err)
+	}
+
+	// If Unmarshal succeeded, so will this:
+	lines, err := jsonLines(bts)
+	if err != nil {
+		return nil, fail(0, "%v", err)
+	}
+
+	for key, line := range lines {
+		parts := strings.Split(key, ".")
+		if len(parts) == 1 && !configKeys[parts[0]] {
+			return nil, fail(line, "unknown key %q", parts[0])
+		}
+		if len(parts) == 3 && parts[0] == "databases" && !databaseConfigKeys[parts[2]] {
+			return nil, fail(line, "unknown key %q in database", parts[2])
+		}
+		if len(parts) == 3 && parts[0] == "views" && !viewConfigKeys[parts[2]] {
+			return nil, fail(line, "unknown key %q in view", parts[2])
+		}
+	}
+
+	if config.Poll != "" {
+		config.PollInterval, err = time.ParseDuration(config.Poll)
+		if err != nil {
+			return nil, fail(lines["poll"], "invalid poll interval %q", config.Poll)
+		}
+	}
+
+	base := filepath.Dir(file)
+	if config.Mount != "" && !filepath.IsAbs(config.Mount) {
+		config.Mount = filepath.Join(base, config.Mount)
+	}
+	if config.Aliases != "" && !filepath.IsAbs(config.Aliases) {
+		config.Aliases = filepath.Join(base, config.Aliases)
+	}
+	if config.Index != nil && *config.Index != "" && !filepath.IsAbs(*config.Index) {
+		index := filepath.Join(base, *config.Index)
+		config.Index = &index
+	}
+
+	validViews := map[string]bool{}
+	special := map[string]bool{}
+	for _, view := range specialViews {
+		validViews[view] = true
+		special[view] = true
+	}
+	for _, view := range DefaultViews {
+		validViews[view.Name] = true
+	}
+	defined := map[string]bool{}
+	for i, view := range config.Views {
+		key := "views." + strconv.Itoa(i)
+		if special[view.Name] || view.Name == QueryDir {
+			return nil, fail(lines[key+".name"], "view %q can't be redefined", view.Name)
+		}
+		if defined[view.Name] {
+			return nil, fail(lines[key+".name"], "view %q is defined more than once", view.Name)
+		}
+		defined[view.Name] = true
+
+		if _, err := NewView(view); err != nil {
+			line := lines[key+".path"]
+			if line == 0 {
+				line = lines[key]
+			}
+			return nil, fail(line, "%v", err)
+		}
+		validViews[view.Name] = true
+	}
+	var viewNames []string
+	for name := range validViews {
+		viewNames = append(viewNames, name)
+	}
+	sort.Strings(viewNames)
+
+	for i, view := range config.Symlinks {
+		if view != "*" && view != QueryDir && !validViews[view] {
+			return nil, fail(lines[fmt.Sprintf("symlinks.%d", i)],
+				"unknown view %q in symlinks, expected '*', %q or one of %s", view, QueryDir, strings.Join(viewNames, ", "))
+		}
+	}
+
+	names := map[string]bool{}
+	for i := range config.Databases {
+		db := &config.Databases[i]
+		key := "databases." + strconv.Itoa(i)
+		line := lines[key]
+
+		if db.Name == "" {
+			return nil, fail(line, "database has no name")
+		}
+		if names[db.Name] {
+			return nil, fail(lines[key+".name"], "database name %q is used more than once", db.Name)
+		}
+		names[db.Name] = true
+
+		if len(db.Paths) == 0 {
+			return nil, fail(line, "database %q has no paths", db.Name)
+		}
+		for j, path := range db.Paths {
+			if path == "" {
+				return nil, fail(lines[fmt.Sprintf("%s.paths.%d", key, j)], "database %q has an empty path", db.Name)
+			}
+			if !filepath.IsAbs(path) {
+				db.Paths[j] = filepath.Join(base, path)
+			}
+		}
+
+		for _, field := range []struct {
+			name string
+			exts []string
+		}{
+			{"audioExtensions", db.AudioExtensions},
+			{"playlistExtensions", db.PlaylistExtensions},
+			{"sidecarExtensions", db.SidecarExtensions},
+		} {
+			for j, ext := range field.exts {
+				if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+					return nil, fail(lines[fmt.Sprintf("%s.%s.%d", key, field.name, j)],
+						"extension %q in database %q should start with a '.'", ext, db.Name)
+				}
+			}
+		}
+
+		for j, pattern := range db.Ignore {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fail(lines[fmt.Sprintf("%s.ignore.%d", key, j)],
+					"invalid ignore pattern %q in database %q", pattern, db.Name)
+			}
+		}
+
+		for j, view := range db.Views {
+			if !validViews[view] {
+				return nil, fail(lines[fmt.Sprintf("%s.views.%d", key, j)],
+					"unknown view %q in database %q, expected one of %s", view, db.Name, strings.Join(viewNames, ", "))
+			}
+		}
+	}
+
+	return &config, nil
+}
+
+// jsonLines maps the dotted path of every value in a JSON document, such as
+// "databases.0.paths.1", to the line on which the value starts.
+func jsonLines(bts []byte) (map[string]int, error) {
+	dec := json.NewDecoder(bytes.NewReader(bts))
+	lines := map[string]int{}
+
+	var walk func(path string) error
+	walk = func(path string) error {
+		start := jsonValueStart(bts, dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if path != "" {
+			lines[path] = lineAt(bts, start)
+		}
+
+		join := func(key string) string {
+			if path == "" {
+				return key
+			}
+			return path + "." + key
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				if err := walk(join(key.(string))); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(join(strconv.Itoa(i))); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		}
+		return nil
+	}
+
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+func jsonValueStart(bts []byte, offset int64) int64 {
+	for offset < int64(len(bts)) {
+		switch bts[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+func lineAt(bts []byte, offset int64) int {
+	if offset > int64(len(bts)) {
+		offset = int64(len(bts))
+	}
+	return bytes.Count(bts[:offset], []byte{'\n'}) + 1
+}
@@ -0,0 +1,62 @@
+package musefuse
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig("/etc/musefuse.json", []byte(`{
+  "mount": "/mnt/muse",
+  "poll": "1m",
+  "databases": [
+    {
+      "name": "music",
+      "paths": ["/music", "more"],
+      "ignore": ["Incoming"],
+      "views": ["artist", "failed"]
+    }
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.PollInterval.String() != "1m0s" {
+		t.Fatal(config.PollInterval)
+	}
+	db := config.Databases[0].Database()
+	if db.Paths[1] != "/etc/more" {
+		t.Fatal("relative path not resolved", db.Paths)
+	}
+	if len(db.AudioExtensions) != len(AudioExtensions) {
+		t.Fatal("default extensions not applied")
+	}
+}
+
+func TestParseConfigErrorLines(t *testing.T) {
+	for idx, tc := range []struct {
+		line int
+		in   string
+	}{
+		{2, "{\n  \"mount\": 1\n}"},
+		{3, "{\n  \"mount\": \"/a\",\n  \"mount\" \"/b\"\n}"},
+		{3, "{\n  \"mount\": \"/a\",\n  \"bogus\": true\n}"},
+		{4, "{\n  \"databases\": [\n    {\"name\": \"a\", \"paths\": [\"/a\"]},\n    {\"name\": \"a\", \"paths\": [\"/b\"]}\n  ]\n}"},
+		{5, "{\n  \"databases\": [{\n    \"name\": \"a\",\n    \"paths\": [\"/a\"],\n    \"views\": [\"nope\"]\n  }]\n}"},
+		{6, "{\n  \"databases\": [{\n    \"name\": \"a\",\n    \"paths\": [\"/a\"],\n    \"ignore\": [\n      \"[\"\n    ]\n  }]\n}"},
+		{2, "{\n  \"databases\": [{\"name\": \"a\"}]\n}"},
+		{2, "{\n  \"poll\": \"soon\"\n}"},
+		{3, "{\n  \"symlinks\": [\"failed\",\n    \"nope\"]\n}"},
+		{3, "{\n  \"views\": [{\"path\": \"q/{{.Title}}\",\n    \"name\": \"query\"}]\n}"},
+		{3, "{\n  \"views\": [{\"name\": \"mine\",\n    \"path\": \"source/{{.Title}}\"}]\n}"},
+	} {
+		_, err := ParseConfig("test.json", []byte(tc.in))
+		var cerr *ConfigError
+		if !errors.As(err, &cerr) {
+			t.Fatal(idx, "expected ConfigError, found", err)
+		}
+		if cerr.Line != tc.line {
+			t.Fatal(idx, "expected line", tc.line, "found", cerr)
+		}
+	}
+}
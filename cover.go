@@ -0,0 +1,220 @@
+package musefuse
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// coverExtensions are the image files that findSidecarCover will use.
+var coverExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".bmp": true, ".webp": true}
+
+// coverNames are the names given to cover art in a View with Cover set.
+var coverNames = []string{"cover", "folder"}
+
+// coverSource is where a coverNode gets its data: either the picture embedded
+// in an audio file, or an image file.
+type coverSource struct {
+	path     string
+	embedded bool
+	ext      string
+	size     int64
+	modTime  time.Time
+}
+
+type coverNode struct {
+	inode  uint64
+	name   string
+	source coverSource
+}
+
+func (cover *coverNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = cover.inode
+	a.Mode = 0600
+	a.Size = uint64(cover.source.size)
+	a.Mtime = cover.source.modTime
+	return nil
+}
+
+func (cover *coverNode) ReadAll(ctx context.Context) ([]byte, error) {
+	if !cover.source.embedded {
+		return ioutil.ReadFile(cover.source.path)
+	}
+	pic, err := LoadPicture(cover.source.path)
+	if err != nil {
+		return nil, err
+	} else if pic == nil {
+		return nil, fuse.ENOENT
+	}
+	return pic.Data, nil
+}
+
+// UpdateCovers looks again for cover images in the source directory path, and
+// any directory beneath it, and replaces the cover art of every directory that
+// shows files from them. The images found are cached, so the FS needs to be
+// told whenever one is added, changed or removed.
+func (fs *FS) UpdateCovers(path string) {
+	fs.lock.Lock()
+	prefix := path + string(filepath.Separator)
+	under := func(srcDir string) bool {
+		return srcDir == path || strings.HasPrefix(srcDir, prefix)
+	}
+
+	for srcDir := range fs.sidecarCovers {
+		if under(srcDir) {
+			delete(fs.sidecarCovers, srcDir)
+		}
+	}
+
+	var dirs []*dirNode
+	seen := map[*dirNode]bool{}
+	for srcDir, keys := range fs.sourceDirs {
+		if !under(srcDir) {
+			continue
+		}
+		for key := range keys {
+			for _, file := range fs.nodes[key] {
+				dir := file.parent
+				if dir != nil && dir.showCovers && !seen[dir] {
+					seen[dir] = true
+					dirs = append(dirs, dir)
+				}
+			}
+		}
+	}
+	for _, dir := range dirs {
+		fs.updateCover(dir)
+	}
+	pending := fs.takePending()
+	fs.lock.Unlock()
+
+	fs.invalidate(pending)
+}
+
+// updateCover replaces the cover art in dir, which must be in a View with
+// Cover set, with the best one available from dir's files. It must be called
+// with fs.lock held.
+func (fs *FS) updateCover(dir *dirNode) {
+	source, ok := fs.findCover(dir)
+	if len(dir.covers) > 0 && ok && dir.covers[0].source == source {
+		return
+	}
+
+	for _, cover := range dir.covers {
+		fs.pending = append(fs.pending, invalidation{dir, cover.name})
+	}
+	dir.removeCovers()
+	if !ok {
+		return
+	}
+
+	for _, base := range coverNames {
+		name := base + source.ext
+		if _, ok := dir.index[name]; ok {
+			continue // Don't hide a track that happens to have the same name.
+		}
+		ino := fs.inode(dir.childPath(name), &FileInfo{Path: source.path, Size: source.size, ModTime: source.modTime})
+		dir.addCover(&coverNode{inode: ino, name: name, source: source})
+		fs.pending = append(fs.pending, invalidation{dir, name})
+	}
+}
+
+// findCover returns the picture embedded in the file in dir whose source
+// sorts first, or failing that the sidecar cover next to the source files
+// whose directory sorts first, so the same cover is found whatever order the
+// files were added in.
+func (fs *FS) findCover(dir *dirNode) (coverSource, bool) {
+	var embedded *FileEntry
+	for _, file := range dir.files {
+		meta := file.entry.Metadata
+		if meta != nil && meta.Picture != nil && meta.PictureSize > 0 {
+			if embedded == nil || fileLess(file.entry.File, embedded.File) {
+				embedded = file.entry
+			}
+		}
+	}
+	if embedded != nil {
+		return coverSource{
+			path:     embedded.File.FullPath(),
+			embedded: true,
+			ext:      PictureExt(embedded.Metadata.Picture),
+			size:     int64(embedded.Metadata.PictureSize),
+			modTime:  embedded.File.ModTime,
+		}, true
+	}
+
+	var found coverSource
+	for _, file := range dir.files {
+		srcDir := filepath.Dir(file.entry.File.FullPath())
+		source, ok := fs.sidecarCovers[srcDir]
+		if !ok {
+			source = findSidecarCover(srcDir)
+			fs.sidecarCovers[srcDir] = source
+		}
+		if source.path != "" && (found.path == "" || source.path < found.path) {
+			found = source
+		}
+	}
+	return found, found.path != ""
+}
+
+// isCoverImage reports whether the file at path is one findSidecarCover may
+// use.
+func isCoverImage(path string) bool {
+	if !coverExtensions[strings.ToLower(filepath.Ext(path))] {
+		return false
+	}
+	base := strings.ToLower(trimExt(filepath.Base(path), ""))
+	for _, name := range coverNames {
+		if base == name {
+			return true
+		}
+	}
+	return false
+}
+
+// findSidecarCover looks for a "cover.*" or "folder.*" image in dir, in that
+// order of preference. The result's path is empty if there isn't one.
+func findSidecarCover(dir string) coverSource {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return coverSource{}
+	}
+
+	var candidates []coverSource
+	for _, info := range infos {
+		ext := strings.ToLower(filepath.Ext(info.Name()))
+		if info.IsDir() || !coverExtensions[ext] {
+			continue
+		}
+		base := strings.ToLower(trimExt(info.Name(), ""))
+		for _, name := range coverNames {
+			if base == name {
+				if ext == ".jpeg" {
+					ext = ".jpg"
+				}
+				candidates = append(candidates, coverSource{
+					path:    filepath.Join(dir, info.Name()),
+					ext:     ext,
+					size:    info.Size(),
+					modTime: info.ModTime(),
+				})
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return coverSource{}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		bi := strings.ToLower(filepath.Base(candidates[i].path))
+		bj := strings.ToLower(filepath.Base(candidates[j].path))
+		return strings.HasPrefix(bi, coverNames[0]) && !strings.HasPrefix(bj, coverNames[0])
+	})
+	return candidates[0]
+}
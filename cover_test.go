@@ -0,0 +1,102 @@
+package musefuse
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dhowden/tag"
+)
+
+func TestFSCoverEmbedded(t *testing.T) {
+	fs := NewFS()
+	plain := testEntry("a.mp3", &Metadata{Artist: "Foo", Album: "X", Title: "A", Track: 1})
+	pic := testEntry("b.mp3", &Metadata{Artist: "Foo", Album: "X", Title: "B", Track: 2,
+		Picture: &tag.Picture{MIMEType: "image/png", Ext: "png"}, PictureSize: 123})
+	for _, e := range []*FileEntry{plain, pic} {
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"cover.png", "folder.png"} {
+		cover, ok := fs.lookup("artistalbum/Foo/X/" + name).(*coverNode)
+		if !ok {
+			t.Fatal("expected cover", name)
+		}
+		if !cover.source.embedded || cover.source.path != "/music/b.mp3" || cover.source.size != 123 {
+			t.Fatal("unexpected cover source", cover.source)
+		}
+	}
+	if fs.lookup("artist/Foo/cover.png") != nil {
+		t.Fatal("unexpected cover in view without Cover")
+	}
+
+	fs.RemoveAudio(pic.File.FullPath())
+	if fs.lookup("artistalbum/Foo/X/cover.png") != nil {
+		t.Fatal("expected cover to be removed with its source")
+	}
+	fs.RemoveAudio(plain.File.FullPath())
+	if fs.lookup("artistalbum/Foo/X") != nil {
+		t.Fatal("expected album dir to be pruned")
+	}
+}
+
+func TestFSCoverIgnoresOrder(t *testing.T) {
+	png := &Metadata{Artist: "Foo", Album: "X", Title: "B", Track: 2,
+		Picture: &tag.Picture{MIMEType: "image/png", Ext: "png"}, PictureSize: 123}
+	jpg := &Metadata{Artist: "Foo", Album: "X", Title: "C", Track: 3,
+		Picture: &tag.Picture{MIMEType: "image/jpeg", Ext: "jpg"}, PictureSize: 456}
+
+	for _, order := range [][]*FileEntry{
+		{testEntry("b.mp3", png), testEntry("c.mp3", jpg)},
+		{testEntry("c.mp3", jpg), testEntry("b.mp3", png)},
+	} {
+		fs := NewFS()
+		for _, e := range order {
+			if err := fs.AddAudio(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cover, ok := fs.lookup("artistalbum/Foo/X/cover.png").(*coverNode)
+		if !ok || cover.source.path != "/music/b.mp3" {
+			t.Fatal("expected cover from the first file whatever the order", order[0].File.Path)
+		}
+	}
+}
+
+func TestFSCoverSidecar(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "musefuse-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	data := []byte("not really a png")
+	if err := ioutil.WriteFile(filepath.Join(tmp, "Folder.PNG"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewFS()
+	entry := &FileEntry{
+		File:     FileInfo{Prefix: tmp, Path: "a.mp3", Kind: FileAudio},
+		Metadata: &Metadata{Artist: "Foo", Album: "X", Title: "A"},
+	}
+	if err := fs.AddAudio(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	cover, ok := fs.lookup("artistalbum/Foo/X/cover.png").(*coverNode)
+	if !ok {
+		t.Fatal("expected sidecar cover")
+	}
+	bts, err := cover.ReadAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bts) != string(data) {
+		t.Fatal("unexpected cover data", string(bts))
+	}
+}
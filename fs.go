@@ -2,112 +2,603 @@ package musefuse
 
 import (
 	"fmt"
-	"math/rand"
+	"hash/fnv"
 	"path/filepath"
 	"regexp"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
 
+	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 )
 
 type FS struct {
-	root      *dirNode
-	entries   []*FileEntry
-	failed    []*FileEntry
-	handles   *handleMap
-	nextInode uint64
+	root    *dirNode
+	handles *handleMap
+
+	// inodes contains the identity of every node an inode has been handed out
+	// for; see FS.inode.
+	inodes map[uint64]string
+
+	// entries and nodes are keyed by FileInfo.FullPath(). nodes contains every
+	// fileNode created for an entry so the entry can be removed again.
+	entries map[string]*FileEntry
+	nodes   map[string][]*fileNode
+
+	// lock serialises mutations to the tree, and protects everything in FS
+	// below it. FUSE requests don't need it; dirNode has its own lock for
+	// readers.
+	lock        sync.Mutex
+	invalidator Invalidator
+	pending     []invalidation
+
+	views []*View
+
+	// delimiters split artist and genre tags for the views with
+	// ViewConfig.Each.
+	delimiters []string
+
+	// names chooses the spelling shown for artists, albums and genres.
+	names *tagNames
+
+	// dbViews contains the enabled views for each database; databases not
+	// present get every view.
+	dbViews map[string]map[string]bool
+
+	// dbRoots contains the name of the directory in ViewSource for each path
+	// of the databases with more than one; see SetDatabasePaths.
+	dbRoots map[string]map[string]string
+
+	// albums groups entries by album for ViewComplete and ViewIncomplete,
+	// and for the album names in the template views.
+	albums map[albumKey]*albumGroup
+
+	// albumNames contains the album groups sharing each artist and title,
+	// keyed with no release; see placeAlbum.
+	albumNames map[albumKey][]*albumGroup
+
+	// albumPlaces contains where each entry's album was when the entry was
+	// placed in the template views, and movedAlbums the albumNames whose
+	// albums may have moved since; see replaceMovedAlbums.
+	albumPlaces map[string]albumPlace
+	movedAlbums map[albumKey]bool
+
+	// sidecars contains every FileSidecar, and sourceDirs the keys of every
+	// entry, by the directory containing the source file.
+	sidecars   map[string]map[string]FileInfo
+	sourceDirs map[string]map[string]bool
+
+	// playlists contains every FilePlaylist that could be loaded, and
+	// playlistNames the sorted keys of the playlists sharing each base name;
+	// see placePlaylist.
+	playlists     map[string]*loadedPlaylist
+	playlistNames map[string][]string
+
+	// audioRefs contains the keys of every entry, and playlistRefs the keys
+	// of every playlist with a track, by each of their refs; see entryRefs.
+	audioRefs    map[string]map[string]bool
+	playlistRefs map[string]map[string]bool
+
+	// sidecarCovers caches findSidecarCover for each source directory.
+	sidecarCovers map[string]coverSource
+
+	// symlinks contains the views whose files are symlinks to the source
+	// file; "*" means all of them.
+	symlinks map[string]bool
+
+	// queries is the query/ directory. Its children are the results of
+	// recent queries, oldest first in queryOrder; see lookupQuery.
+	queries    *dirNode
+	queryOrder []*dirNode
+
+	// queryGen changes whenever the results of a query might; see
+	// lookupQuery.
+	queryGen uint64
 }
 
+// Invalidator is used to tell the kernel to forget cached entries and
+// attributes when the tree is changed while mounted. It is implemented by
+// *fs.Server.
+type Invalidator interface {
+	InvalidateEntry(parent fs.Node, name string) error
+	InvalidateNodeAttr(node fs.Node) error
+}
+
+type invalidation struct {
+	dir  *dirNode
+	name string
+}
+
+// The names of the built-in views. The specialViews are built by FS; the rest
+// are defined by DefaultViews.
+const (
+	ViewArtist      = "artist"
+	ViewArtistAlbum = "artistalbum"
+	ViewYear        = "year"
+	ViewGenre       = "genre"
+	ViewQuality     = "quality"
+	ViewMusicBrainz = "mbid"
+	ViewFailed      = "failed"
+	ViewUnsorted    = "unsorted"
+	ViewComplete    = "complete"
+	ViewIncomplete  = "incomplete"
+	ViewSource      = "source"
+
+	// ViewPlaylists has a directory for each playlist, with the tracks that
+	// could be found in playlist order.
+	ViewPlaylists = "playlists"
+
+	// ViewNoReplayGain mirrors the source directories like ViewSource, but
+	// only with the files that are missing ReplayGain tags, so it shows what
+	// still needs to be scanned.
+	ViewNoReplayGain = "noreplaygain"
+)
+
+// specialViews are the built-in views that aren't template views, and can't
+// be redefined.
+var specialViews = []string{ViewFailed, ViewUnsorted, ViewComplete, ViewIncomplete, ViewSource, ViewNoReplayGain, ViewPlaylists}
+
+// isReservedDir reports whether name is one of the top-level directories the
+// FS builds itself: QueryDir or one of the specialViews. A template view can't
+// use it, as whichever was added last would hide the other.
+func isReservedDir(name string) bool {
+	if name == QueryDir {
+		return true
+	}
+	for _, view := range specialViews {
+		if name == view {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryDir is the name of the top-level directory in which any Query can be
+// looked up as a directory of matching files.
+const QueryDir = "query"
+
+// queryCacheSize is the number of query results kept in QueryDir.
+const queryCacheSize = 32
+
+// queryAttempts is the number of times lookupQuery matches a query without
+// holding FS.lock before it gives up and holds it.
+const queryAttempts = 3
+
 func NewFS() *FS {
+	views, err := BuildViews(nil)
+	if err != nil {
+		panic(err)
+	}
+
 	fs := &FS{
-		root:      newDirNode(1, ""),
-		nextInode: 2,
-		handles:   newHandleMap(),
+		root:       newDirNode(rootInode, ""),
+		inodes:     map[uint64]string{rootInode: ""},
+		handles:    newHandleMap(),
+		entries:    map[string]*FileEntry{},
+		nodes:      map[string][]*fileNode{},
+		views:      views,
+		delimiters: DefaultTagDelimiters,
+		names:      newTagNames(),
+		dbViews:    map[string]map[string]bool{},
+		dbRoots:    map[string]map[string]string{},
+		symlinks:   map[string]bool{},
+
+		albums:        map[albumKey]*albumGroup{},
+		albumNames:    map[albumKey][]*albumGroup{},
+		albumPlaces:   map[string]albumPlace{},
+		movedAlbums:   map[albumKey]bool{},
+		sidecars:      map[string]map[string]FileInfo{},
+		sourceDirs:    map[string]map[string]bool{},
+		sidecarCovers: map[string]coverSource{},
+		playlists:     map[string]*loadedPlaylist{},
+		playlistNames: map[string][]string{},
+		audioRefs:     map[string]map[string]bool{},
+		playlistRefs:  map[string]map[string]bool{},
 	}
+
+	fs.queries = newDirNode(fs.inode(QueryDir, nil), QueryDir)
+	fs.queries.dynamic = fs.lookupQuery
+	fs.root.addDir(fs.queries)
+
 	return fs
 }
 
+// SetViews replaces the template views built by AddAudio. It only affects
+// files added after it is called.
+func (fs *FS) SetViews(views []*View) {
+	fs.lock.Lock()
+	fs.views = views
+	fs.lock.Unlock()
+}
+
+// SetTagDelimiters replaces the DefaultTagDelimiters used to split artist and
+// genre tags into several values. It only affects files added after it is
+// called.
+func (fs *FS) SetTagDelimiters(delimiters []string) {
+	fs.lock.Lock()
+	fs.delimiters = delimiters
+	fs.lock.Unlock()
+}
+
+// SetAliases sets the Aliases for artists and genres. It only affects files
+// added after it is called.
+func (fs *FS) SetAliases(aliases *Aliases) {
+	fs.lock.Lock()
+	fs.names.aliases = aliases
+	fs.lock.Unlock()
+}
+
+// SetDatabaseViews restricts the files from the named database to the views
+// listed. It only affects files added after it is called.
+func (fs *FS) SetDatabaseViews(database string, views []string) {
+	enabled := make(map[string]bool, len(views))
+	for _, view := range views {
+		enabled[view] = true
+	}
+
+	fs.lock.Lock()
+	fs.dbViews[database] = enabled
+	fs.lock.Unlock()
+}
+
+// SetSymlinkViews presents the files in the named views as symlinks to the
+// source files, so the kernel can read them directly instead of proxying every
+// read through FUSE. Use "*" for every view, and QueryDir for query results.
+// It only affects files added after it is called.
+func (fs *FS) SetSymlinkViews(views []string) {
+	symlinks := make(map[string]bool, len(views))
+	for _, view := range views {
+		symlinks[view] = true
+	}
+
+	fs.lock.Lock()
+	fs.symlinks = symlinks
+	fs.lock.Unlock()
+}
+
+func (fs *FS) isSymlink(view string) bool {
+	return fs.symlinks["*"] || fs.symlinks[view]
+}
+
+func (fs *FS) hasView(entry *FileEntry, view string) bool {
+	enabled, ok := fs.dbViews[entry.File.Database]
+	return !ok || enabled[view]
+}
+
+// SetInvalidator must be called with the *fs.Server that is serving this FS
+// if the FS is to be changed after it is mounted.
+func (fs *FS) SetInvalidator(inv Invalidator) {
+	fs.lock.Lock()
+	fs.invalidator = inv
+	fs.lock.Unlock()
+}
+
 func (fs *FS) Root() (fs.Node, error) {
 	return fs.root, nil
 }
 
-func (fs *FS) inode() uint64 {
-	next := fs.nextInode
-	fs.nextInode++
-	return next
+const rootInode = 1
+
+// inode returns the inode for the node at the slash-separated virtual path,
+// which is derived from a hash of the path, so it stays the same across
+// remounts and rescans. For files, source is included too, so a file that is
+// changed or replaced gets a new inode and the kernel doesn't serve it from
+// a stale page cache.
+//
+// On a collision, the next free number is used, which is only stable if the
+// nodes are added in the same order. Apart from query results (see
+// removeQuery), inodes are never reused for a different node, as the kernel
+// may still remember the old one. inode must be called with fs.lock held.
+func (fs *FS) inode(path string, source *FileInfo) uint64 {
+	id := path
+	if source != nil {
+		id = fmt.Sprintf("%s\x00%s\x00%d\x00%d", path, source.FullPath(), source.Size, source.ModTime.UnixNano())
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(id))
+	ino := hash.Sum64()
+	for {
+		if ino > rootInode {
+			cur, ok := fs.inodes[ino]
+			if !ok {
+				fs.inodes[ino] = id
+				return ino
+			} else if cur == id {
+				return ino
+			}
+		}
+		ino++
+	}
 }
 
 func (fs *FS) AddAudio(entry *FileEntry) error {
-	fs.entries = append(fs.entries, entry)
+	fs.lock.Lock()
+	err := fs.addAudio(entry)
+	fs.clearQueries()
+	pending := fs.takePending()
+	fs.lock.Unlock()
+
+	fs.invalidate(pending)
+	return err
+}
 
-	if entry.Err != "" {
-		fs.failed = append(fs.failed, entry)
-		title := fmt.Sprintf("%s.%d", trimExt(filepath.Base(entry.File.Path), ""), rand.Int63())
+// UpdateAudio replaces any existing entry for the same file with entry.
+func (fs *FS) UpdateAudio(entry *FileEntry) error {
+	fs.lock.Lock()
+	fs.removeAudio(entry.File.FullPath())
+	err := fs.addAudio(entry)
+	fs.clearQueries()
+	pending := fs.takePending()
+	fs.lock.Unlock()
+
+	fs.invalidate(pending)
+	return err
+}
+
+// RemoveAudio removes the entry for the file at the full path key from every
+// view, pruning any directories left empty. It returns false if there was no
+// such entry.
+func (fs *FS) RemoveAudio(key string) bool {
+	fs.lock.Lock()
+	ok := fs.removeAudio(key)
+	fs.clearQueries()
+	pending := fs.takePending()
+	fs.lock.Unlock()
+
+	fs.invalidate(pending)
+	return ok
+}
+
+func (fs *FS) removeAudio(key string) bool {
+	entry, ok := fs.entries[key]
+	if !ok {
+		return false
+	}
+	fs.unplaceAudio(entry)
 
-		if err := fs.addNode(title, entry, "failed"); err != nil {
+	srcDir := filepath.Dir(key)
+	delete(fs.sourceDirs[srcDir], key)
+	if len(fs.sourceDirs[srcDir]) == 0 {
+		delete(fs.sourceDirs, srcDir)
+	}
+
+	for _, ref := range entryRefs(entry) {
+		delete(fs.audioRefs[ref], key)
+		if len(fs.audioRefs[ref]) == 0 {
+			delete(fs.audioRefs, ref)
+		}
+	}
+
+	delete(fs.entries, key)
+
+	// The other entries were placed before, so they can be placed again:
+	_ = fs.replaceAudio(fs.names.remove(key))
+	_ = fs.replaceMovedAlbums()
+	_ = fs.replacePlaylistsFor(entry)
+	return true
+}
+
+// unplaceAudio removes every node for entry. It must be called with fs.lock
+// held.
+func (fs *FS) unplaceAudio(entry *FileEntry) {
+	key := entry.File.FullPath()
+	nodes := fs.nodes[key]
+	delete(fs.nodes, key)
+	delete(fs.albumPlaces, key)
+	fs.removeNodes(nodes)
+	fs.removeFromAlbum(entry)
+}
+
+// replaceAudio removes and places again the entries with the given keys, as
+// the names they are shown with have changed. It must be called with fs.lock
+// held.
+func (fs *FS) replaceAudio(keys []string) error {
+	for _, key := range keys {
+		entry := fs.entries[key]
+		fs.unplaceAudio(entry)
+		if err := fs.placeAudio(entry); err != nil {
 			return err
 		}
+		if err := fs.replacePlaylistsFor(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	} else if entry.Metadata != nil {
-		added := false
+// removeNodes removes files from their directories, renumbering the files
+// left behind and pruning any directories left empty. The files must already
+// have been removed from fs.nodes. It must be called with fs.lock held.
+func (fs *FS) removeNodes(files []*fileNode) {
+	type nameGroup struct {
+		dir       *dirNode
+		base, ext string
+	}
+	var groups []nameGroup
+	var dirs []*dirNode
+	seenGroups := map[nameGroup]bool{}
+	seenDirs := map[*dirNode]bool{}
+
+	for _, file := range files {
+		dir := file.parent
+		if dir == nil {
+			continue
+		}
+		dir.removeFile(file)
+		fs.pending = append(fs.pending, invalidation{dir, file.name})
 
-		if entry.Metadata.Artist != "" && entry.Metadata.Title != "" {
-			added = true
+		group := nameGroup{dir, file.base, filepath.Ext(file.name)}
+		if file.base != "" && !seenGroups[group] {
+			seenGroups[group] = true
+			groups = append(groups, group)
+		}
+		if !seenDirs[dir] {
+			seenDirs[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, group := range groups {
+		fs.renumber(group.dir, group.base, group.ext, nil)
+	}
+	for _, dir := range dirs {
+		if len(dir.covers) > 0 {
+			fs.updateCover(dir)
+		}
+		if dir.showSidecars {
+			fs.updateSidecars(dir)
+		}
+		fs.prune(dir)
+	}
+}
+
+// prune removes dir, and then each of its parents, if they are empty. It must
+// be called with fs.lock held.
+func (fs *FS) prune(dir *dirNode) {
+	for dir != fs.root && dir.parent != nil && len(dir.entries) == 0 {
+		parent := dir.parent
+		parent.removeDir(dir)
+		fs.pending = append(fs.pending, invalidation{parent, dir.name})
+		dir = parent
+	}
+}
+
+func (fs *FS) takePending() []invalidation {
+	pending := fs.pending
+	fs.pending = nil
+	if fs.invalidator == nil {
+		return nil
+	}
+	return pending
+}
+
+// invalidate must not be called while holding fs.lock; the kernel may call
+// back into the FS while it is handling the notification.
+func (fs *FS) invalidate(pending []invalidation) {
+	if len(pending) == 0 {
+		return
+	}
 
-			if err := fs.addNode(entry.Metadata.Title, entry, "artist", entry.Metadata.Artist); err != nil {
+	fs.lock.Lock()
+	inv := fs.invalidator
+	fs.lock.Unlock()
+
+	seen := make(map[*dirNode]bool, len(pending))
+	for _, p := range pending {
+		// ErrNotCached is the common case and can be safely ignored, as can
+		// anything else; the worst that happens is a stale entry until the
+		// kernel's cache expires.
+		_ = inv.InvalidateEntry(p.dir, p.name)
+		if !seen[p.dir] {
+			seen[p.dir] = true
+			_ = inv.InvalidateNodeAttr(p.dir)
+		}
+	}
+}
+
+func (fs *FS) addAudio(entry *FileEntry) error {
+	key := entry.File.FullPath()
+	fs.entries[key] = entry
+
+	srcDir := filepath.Dir(key)
+	if fs.sourceDirs[srcDir] == nil {
+		fs.sourceDirs[srcDir] = map[string]bool{}
+	}
+	fs.sourceDirs[srcDir][key] = true
+
+	for _, ref := range entryRefs(entry) {
+		if fs.audioRefs[ref] == nil {
+			fs.audioRefs[ref] = map[string]bool{}
+		}
+		fs.audioRefs[ref][key] = true
+	}
+
+	changed := fs.names.add(key, entry, fs.delimiters)
+	if err := fs.placeAudio(entry); err != nil {
+		return err
+	}
+	if err := fs.replaceAudio(changed); err != nil {
+		return err
+	}
+	if err := fs.replaceMovedAlbums(); err != nil {
+		return err
+	}
+	return fs.replacePlaylistsFor(entry)
+}
+
+// placeAudio adds the nodes for entry to every view it belongs in. It must be
+// called with fs.lock held.
+func (fs *FS) placeAudio(entry *FileEntry) error {
+	if fs.hasView(entry, ViewSource) {
+		if err := fs.addMirrorNode(ViewSource, entry); err != nil {
+			return err
+		}
+	}
+
+	if entry.Err != "" {
+		title := fmt.Sprintf("%s [%s]", trimExt(filepath.Base(entry.File.Path), ""), pathHash(entry.File))
+
+		if fs.hasView(entry, ViewFailed) {
+			if _, err := fs.addNode(ViewFailed, title, entry, ViewFailed); err != nil {
 				return err
 			}
+		}
 
-			if entry.Metadata.Album != "" {
-				albumArtist := entry.Metadata.AlbumArtist
-				if albumArtist == "" {
-					albumArtist = entry.Metadata.Artist
-				}
+	} else if entry.Metadata != nil {
+		added := false
 
-				var title string
-				if entry.Metadata.Disc > 0 && (entry.Metadata.Discs > 1 || entry.Metadata.Discs == 0) && entry.Metadata.Track > 0 {
-					title = fmt.Sprintf("%02d-%02d %s", entry.Metadata.Disc, entry.Metadata.Track, entry.Metadata.Title)
-				} else if entry.Metadata.Track > 0 {
-					title = fmt.Sprintf("%02d %s", entry.Metadata.Track, entry.Metadata.Title)
-				} else {
-					title = entry.Metadata.Title
-				}
+		// The album is placed first, as it decides where the entry's album
+		// is shown in the template views:
+		if err := fs.addToAlbum(entry); err != nil {
+			return err
+		}
+		rendered, place, ok := fs.albumView(entry)
+		if ok {
+			fs.albumPlaces[entry.File.FullPath()] = place
+		}
 
-				if err := fs.addNode(title, entry, "artistalbum", albumArtist, entry.Metadata.Album); err != nil {
-					return err
-				}
+		for _, view := range fs.views {
+			paths, name, ok := view.RenderEach(rendered, fs.delimiters, fs.names.display)
+			if !ok {
+				continue
 			}
+			added = true
 
-			if entry.Metadata.Year > 0 {
-				if err := fs.addNode(
-					entry.Metadata.Title,
-					entry,
-					"year", strconv.FormatInt(int64(entry.Metadata.Year), 10), entry.Metadata.Artist,
-				); err != nil {
+			if !fs.hasView(entry, view.Name) {
+				continue
+			}
+			for _, dirs := range paths {
+				file, err := fs.addNode(view.Name, name, entry, dirs...)
+				if err != nil {
 					return err
 				}
+				if view.Cover {
+					file.parent.showCovers = true
+					fs.updateCover(file.parent)
+				}
+				if view.Sidecars {
+					file.parent.showSidecars = true
+					fs.updateSidecars(file.parent)
+				}
 			}
+		}
 
-			if entry.Metadata.Genre != "" {
-				if err := fs.addNode(
-					entry.Metadata.Title,
-					entry,
-					"genre", entry.Metadata.Genre, entry.Metadata.Artist,
-				); err != nil {
-					return err
-				}
+		if !hasReplayGain(entry.Metadata) && fs.hasView(entry, ViewNoReplayGain) {
+			if err := fs.addMirrorNode(ViewNoReplayGain, entry); err != nil {
+				return err
 			}
 		}
 
-		if !added {
+		if !added && fs.hasView(entry, ViewUnsorted) {
 			var title = entry.Metadata.Title
 			if title == "" {
 				title = trimExt(filepath.Base(entry.File.Path), "")
 			}
 
-			title = fmt.Sprintf("%s.%d", title, rand.Int63())
-			if err := fs.addNode(title, entry, "unsorted"); err != nil {
+			title = fmt.Sprintf("%s [%s]", title, pathHash(entry.File))
+			if _, err := fs.addNode(ViewUnsorted, title, entry, ViewUnsorted); err != nil {
 				return err
 			}
 		}
@@ -131,8 +622,8 @@ func (fs *FS) lookup(name string) fs.Node {
 	fname := parts[last]
 
 	for _, part := range parts[:len(parts)-1] {
-		next, ok := dir.index[part]
-		if !ok {
+		next, err := dir.lookupChild(part)
+		if err != nil {
 			return nil
 		} else if nextDir, ok := next.(*dirNode); ok {
 			dir = nextDir
@@ -141,52 +632,265 @@ func (fs *FS) lookup(name string) fs.Node {
 		}
 	}
 
-	node := dir.index[fname]
-	if node != nil {
-		return node
+	node, _ := dir.lookupChild(fname)
+	return node
+}
+
+// lookupQuery is QueryDir's dynamic lookup. It parses name as a Query and
+// builds a directory of every matching file, which stays in QueryDir until it
+// is pushed out by newer queries or the FS changes.
+func (fs *FS) lookupQuery(name string) (fs.Node, error) {
+	query, err := ParseQuery(name)
+	if err != nil {
+		return nil, fuse.ENOENT
 	}
-	return nil
+
+	for attempt := 1; ; attempt++ {
+		fs.lock.Lock()
+
+		// Another request may have beaten us to it:
+		if node, ok := fs.queries.index[name]; ok {
+			fs.lock.Unlock()
+			return node, nil
+		}
+
+		// Matching a big library takes a while, so it's done on a snapshot of
+		// the entries without holding up the mutators. If the FS changes in
+		// the meantime, the results can't be kept, so we try again, until
+		// there have been too many changes and it's simpler to hold the lock:
+		gen := fs.queryGen
+		entries := make([]*FileEntry, 0, len(fs.entries))
+		for _, entry := range fs.entries {
+			entries = append(entries, entry)
+		}
+		locked := attempt >= queryAttempts
+		if !locked {
+			fs.lock.Unlock()
+		}
+
+		var matches []*FileEntry
+		for _, entry := range entries {
+			if query.Match(entry) {
+				matches = append(matches, entry)
+			}
+		}
+		sort.Slice(matches, func(i, j int) bool {
+			return fileLess(matches[i].File, matches[j].File)
+		})
+
+		if !locked {
+			fs.lock.Lock()
+			if fs.queryGen != gen {
+				fs.lock.Unlock()
+				continue
+			}
+		}
+		dir := fs.addQuery(name, matches)
+		fs.lock.Unlock()
+		return dir, nil
+	}
+}
+
+// addQuery adds a directory containing matches to QueryDir, evicting the
+// oldest if there are too many. It must be called with fs.lock held.
+func (fs *FS) addQuery(name string, matches []*FileEntry) *dirNode {
+	dirPath := QueryDir + "/" + name
+	dir := newDirNode(fs.inode(dirPath, nil), name)
+	for _, entry := range matches {
+		title := trimExt(filepath.Base(entry.File.Path), "")
+		if meta := entry.Metadata; meta != nil && meta.Title != "" {
+			title = meta.Title
+			if meta.Artist != "" {
+				title = fs.names.display(nameArtist, meta.Artist) + " - " + title
+			}
+		}
+		title = dir.uniqueName(sanitisePart.ReplaceAllString(title, "_"), filepath.Ext(entry.File.Path))
+		file := newFileNode(fs.handles, fs.inode(dirPath+"/"+title, &entry.File), title, entry)
+		file.symlink = fs.isSymlink(QueryDir)
+		dir.addFile(file)
+	}
+	fs.queries.addDir(dir)
+	fs.queryOrder = append(fs.queryOrder, dir)
+
+	var evicted []invalidation
+	for len(fs.queryOrder) > queryCacheSize {
+		old := fs.queryOrder[0]
+		fs.queryOrder = fs.queryOrder[1:]
+		fs.removeQuery(old)
+		evicted = append(evicted, invalidation{fs.queries, old.name})
+	}
+
+	if fs.invalidator != nil && len(evicted) > 0 {
+		// The kernel holds the lock on QueryDir while it waits for this lookup,
+		// so invalidating now would deadlock:
+		go fs.invalidate(evicted)
+	}
+
+	return dir
 }
 
-func (fs *FS) addNode(name string, entry *FileEntry, path ...string) error {
-	ext := filepath.Ext(entry.File.Path)
+// clearQueries empties QueryDir, as the results may no longer be correct. It
+// must be called with fs.lock held.
+func (fs *FS) clearQueries() {
+	fs.queryGen++
+	for _, dir := range fs.queryOrder {
+		fs.removeQuery(dir)
+		fs.pending = append(fs.pending, invalidation{fs.queries, dir.name})
+	}
+	fs.queryOrder = nil
+}
+
+// removeQuery removes a directory from QueryDir. Query results come and go
+// far more often than anything else, so unlike other nodes, their inodes are
+// handed back; looking the same query up again gives the same inodes anyway,
+// as they are derived from the same paths. It must be called with fs.lock
+// held.
+func (fs *FS) removeQuery(dir *dirNode) {
+	fs.queries.removeDir(dir)
+	delete(fs.inodes, dir.inode)
+	for _, file := range dir.files {
+		delete(fs.inodes, file.inode)
+	}
+}
+
+// addNode adds entry to the tree as path/name, for the view called view, and
+// records the node so it is removed along with the entry.
+func (fs *FS) addNode(view string, name string, entry *FileEntry, path ...string) (*fileNode, error) {
+	return fs.addMatchedNode(view, name, entry, nil, path...)
+}
+
+// addMatchedNode is addNode for a playlist track that was matched to entry as
+// described by match.
+func (fs *FS) addMatchedNode(view string, name string, entry *FileEntry, match *PlaylistMatch, path ...string) (*fileNode, error) {
+	dir, err := fs.mkdirAll(path...)
+	if err != nil {
+		return nil, err
+	}
+
+	file := newFileNode(fs.handles, 0, "", entry)
+	file.view = view
+	file.match = match
+	file.base = sanitisePart.ReplaceAllString(name, "_")
+	file.symlink = fs.isSymlink(view)
+	return fs.renumber(dir, file.base, filepath.Ext(entry.File.Path), file), nil
+}
+
+// renumber names the files in dir that want the name base+ext, plus add if it
+// is not nil. If there are more than one, they are suffixed with " v2", " v3",
+// etc, in order of their source paths, so the names come out the same no
+// matter what order the files were added or removed in. Files whose names
+// change are replaced with new nodes. It returns the node added for add.
+func (fs *FS) renumber(dir *dirNode, base, ext string, add *fileNode) (added *fileNode) {
+	var group []*fileNode
+	if add != nil {
+		group = append(group, add)
+	}
+	_, taken := dir.index[base+ext]
+	_, suffixed := dir.index[base+" v2"+ext]
+	if taken || suffixed {
+		for _, other := range dir.files {
+			if other.base == base && filepath.Ext(other.name) == ext {
+				group = append(group, other)
+			}
+		}
+		sort.SliceStable(group, func(i, j int) bool {
+			return fileLess(group[i].entry.File, group[j].entry.File)
+		})
+	}
+
+	// Work out the names first, as some may need to swap:
+	names := make([]string, len(group))
+	chosen := map[string]bool{}
+	ver := 1
+	for i, member := range group {
+		for {
+			candidate := base + ext
+			if ver > 1 {
+				candidate = fmt.Sprintf("%s v%d%s", base, ver, ext)
+			}
+			ver++
+			node, exists := dir.index[candidate]
+			if other, ok := node.(*fileNode); (!exists || ok && other.base == base) && !chosen[candidate] {
+				names[i] = candidate
+				chosen[candidate] = true
+				break
+			}
+		}
+		if member != add && member.name != names[i] {
+			dir.removeFile(member)
+			fs.pending = append(fs.pending, invalidation{dir, member.name})
+		}
+	}
+
+	for i, member := range group {
+		if member != add && member.name == names[i] {
+			continue
+		}
+		renamed := newFileNode(fs.handles, fs.inode(dir.childPath(names[i]), &member.entry.File), names[i], member.entry)
+		renamed.view, renamed.base, renamed.symlink = member.view, member.base, member.symlink
+		renamed.match = member.match
+		dir.addFile(renamed)
+		fs.pending = append(fs.pending, invalidation{dir, names[i]})
+
+		key := member.entry.File.FullPath()
+		if member == add {
+			added = renamed
+			fs.nodes[key] = append(fs.nodes[key], renamed)
+		} else {
+			for j, node := range fs.nodes[key] {
+				if node == member {
+					fs.nodes[key][j] = renamed
+				}
+			}
+		}
+	}
 
+	return added
+}
+
+// mkdirAll returns the directory at path, creating any that are missing.
+func (fs *FS) mkdirAll(path ...string) (*dirNode, error) {
 	dir := fs.root
 	for _, part := range path {
 		part = sanitisePart.ReplaceAllString(part, "_")
 
 		next, ok := dir.index[part]
 		if !ok {
-			nextDir := newDirNode(fs.inode(), part)
+			nextDir := newDirNode(fs.inode(dir.childPath(part), nil), part)
 			dir.addDir(nextDir)
+			fs.pending = append(fs.pending, invalidation{dir, part})
 			dir = nextDir
 
 		} else if nextDir, ok := next.(*dirNode); ok {
 			dir = nextDir
 
 		} else {
-			return fmt.Errorf("musefuse: can't replace dir with file")
+			return nil, fmt.Errorf("musefuse: can't replace dir with file")
 		}
 	}
+	return dir, nil
+}
 
-	name = sanitisePart.ReplaceAllString(name, "_")
-	baseName := name
-	name += ext
-
-	{ // Ensure name is unique:
-		ver := 2
-		for {
-			if _, ok := dir.index[name]; !ok {
-				break
-			}
-			name = fmt.Sprintf("%s v%d%s", baseName, ver, ext)
-			ver++
+// findDir returns the directory at path, or nil if there isn't one.
+func (fs *FS) findDir(path ...string) *dirNode {
+	dir := fs.root
+	for _, part := range path {
+		next, ok := dir.index[sanitisePart.ReplaceAllString(part, "_")].(*dirNode)
+		if !ok {
+			return nil
 		}
+		dir = next
 	}
+	return dir
+}
 
-	dir.addFile(newFileNode(fs.handles, fs.inode(), name, entry))
-
-	return nil
+// pathHash returns a short hash of the file's path, which is used to keep the
+// names in ViewFailed and ViewUnsorted unique without making them change from
+// one mount to the next.
+func pathHash(file FileInfo) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(file.FullPath()))
+	return fmt.Sprintf("%08x", hash.Sum32())
 }
 
 // Remove ascii control and unsupported filename chars:
@@ -0,0 +1,444 @@
+package musefuse
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func testEntry(path string, meta *Metadata) *FileEntry {
+	return &FileEntry{
+		File:     FileInfo{Prefix: "/music", Path: path, Kind: FileAudio},
+		Metadata: meta,
+	}
+}
+
+func TestFSRemoveAudioPrunesEmptyDirs(t *testing.T) {
+	fs := NewFS()
+	a := testEntry("a.mp3", &Metadata{Artist: "Foo", Title: "A", Album: "X"})
+	b := testEntry("b.mp3", &Metadata{Artist: "Foo", Title: "B", Album: "Y"})
+	for _, e := range []*FileEntry{a, b} {
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if fs.lookup("artistalbum/Foo/X/A.mp3") == nil {
+		t.Fatal("expected file")
+	}
+
+	if !fs.RemoveAudio(a.File.FullPath()) {
+		t.Fatal("expected removal")
+	}
+	if fs.lookup("artistalbum/Foo/X") != nil {
+		t.Fatal("expected empty album dir to be pruned")
+	}
+	if fs.lookup("artistalbum/Foo/Y/B.mp3") == nil {
+		t.Fatal("expected sibling to remain")
+	}
+
+	fs.RemoveAudio(b.File.FullPath())
+	if fs.lookup("artistalbum") != nil {
+		t.Fatal("expected view to be pruned")
+	}
+	if fs.RemoveAudio(b.File.FullPath()) {
+		t.Fatal("unexpected second removal")
+	}
+}
+
+func TestFSSymlinkViews(t *testing.T) {
+	fs := NewFS()
+	fs.SetSymlinkViews([]string{ViewFailed})
+	ctx := context.Background()
+
+	ok := testEntry("a.mp3", &Metadata{Artist: "Foo", Title: "A", Album: "X"})
+	bad := testEntry("b.mp3", nil)
+	bad.Err = "boom"
+	for _, e := range []*FileEntry{ok, bad} {
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file := fs.lookup("artistalbum/Foo/X/A.mp3").(*fileNode)
+	if _, err := file.Readlink(ctx, &fuse.ReadlinkRequest{}); err == nil {
+		t.Fatal("expected error reading link of proxied file")
+	}
+
+	ents := fs.lookup(ViewFailed).(*dirNode).dirents()
+	if len(ents) != 1 || ents[0].Type != fuse.DT_Link {
+		t.Fatal("expected symlink in failed/, found", ents)
+	}
+	link := fs.lookup(ViewFailed + "/" + ents[0].Name).(*fileNode)
+	var attr fuse.Attr
+	if err := link.Attr(ctx, &attr); err != nil {
+		t.Fatal(err)
+	}
+	if attr.Mode&os.ModeSymlink == 0 {
+		t.Fatal("expected symlink mode, found", attr.Mode)
+	}
+	target, err := link.Readlink(ctx, &fuse.ReadlinkRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "/music/b.mp3" {
+		t.Fatal("unexpected target", target)
+	}
+}
+
+// TestFSConcurrentMutation is only really useful with -race.
+func TestFSConcurrentMutation(t *testing.T) {
+	fs := NewFS()
+	ctx := context.Background()
+
+	entries := make([]*FileEntry, 200)
+	for i := range entries {
+		entries[i] = testEntry(fmt.Sprintf("%d.mp3", i), &Metadata{
+			Artist: fmt.Sprintf("artist%d", i%5),
+			Album:  fmt.Sprintf("album%d", i%10),
+			Title:  fmt.Sprintf("title%d", i),
+			Genre:  "genre",
+			Year:   1990 + i%3,
+		})
+	}
+
+	var readers sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			var walk func(dir *dirNode)
+			walk = func(dir *dirNode) {
+				ents, err := dir.ReadDirAll(ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, ent := range ents {
+					node, err := dir.Lookup(ctx, ent.Name)
+					if err != nil {
+						continue // Removed since ReadDirAll; that's fine.
+					}
+					var attr fuse.Attr
+					if err := node.Attr(ctx, &attr); err != nil {
+						t.Error(err)
+					}
+					if sub, ok := node.(*dirNode); ok {
+						walk(sub)
+					}
+				}
+			}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				walk(fs.root)
+				fs.lookup("artistalbum/artist1/album1")
+				fs.lookup(QueryDir + "/year=1991")
+			}
+		}()
+	}
+
+	for round := 0; round < 5; round++ {
+		for _, e := range entries {
+			if err := fs.AddAudio(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, e := range entries[:100] {
+			if err := fs.UpdateAudio(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, e := range entries {
+			fs.RemoveAudio(e.File.FullPath())
+		}
+	}
+
+	close(stop)
+	readers.Wait()
+
+	if ents, _ := fs.root.ReadDirAll(ctx); len(ents) != 1 || ents[0].Name != QueryDir {
+		t.Fatal("expected only the query dir in root, found", ents)
+	}
+}
+
+func TestFSQueryDir(t *testing.T) {
+	fs := NewFS()
+	for i, year := range []int{1959, 1960, 1965, 1970} {
+		e := testEntry(fmt.Sprintf("%d.mp3", i), &Metadata{Artist: "Foo", Title: fmt.Sprint(year), Genre: "Jazz", Year: year})
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := "genre=jazz AND year>=1960 AND year<1970"
+	node := fs.lookup(QueryDir + "/" + query)
+	dir, ok := node.(*dirNode)
+	if !ok {
+		t.Fatal("expected query dir, found", node)
+	}
+	ents := dir.dirents()
+	if len(ents) != 2 || ents[0].Name != "Foo - 1960.mp3" || ents[1].Name != "Foo - 1965.mp3" {
+		t.Fatal("unexpected results", ents)
+	}
+	if fs.lookup(QueryDir+"/"+query) != dir {
+		t.Fatal("expected cached result")
+	}
+	if fs.lookup(QueryDir+"/year>") != nil {
+		t.Fatal("expected invalid query to be missing")
+	}
+
+	// Changing the FS clears the cache:
+	fs.RemoveAudio("/music/1.mp3")
+	if len(fs.queries.dirents()) != 0 {
+		t.Fatal("expected cache to be cleared")
+	}
+	inodes := len(fs.inodes)
+	dir = fs.lookup(QueryDir + "/" + query).(*dirNode)
+	if len(dir.dirents()) != 1 {
+		t.Fatal("unexpected results", dir.dirents())
+	}
+
+	for i := 0; i < queryCacheSize+5; i++ {
+		fs.lookup(fmt.Sprintf("%s/year=%d", QueryDir, i))
+	}
+	if n := len(fs.queries.dirents()); n != queryCacheSize {
+		t.Fatal("expected cache to be limited, found", n)
+	}
+
+	// The inodes of the results are handed back once they are gone, as there
+	// is no end to the queries that can be looked up:
+	if n := len(fs.inodes); n != inodes+queryCacheSize {
+		t.Fatal("expected evicted inodes to be released", n)
+	}
+	fs.lock.Lock()
+	fs.clearQueries()
+	fs.lock.Unlock()
+	if n := len(fs.inodes); n != inodes {
+		t.Fatal("expected cleared inodes to be released", n)
+	}
+}
+
+func TestFSInodesAreStable(t *testing.T) {
+	ctx := context.Background()
+	a := testEntry("a.mp3", &Metadata{Artist: "Foo", Title: "A", Album: "X"})
+	b := testEntry("b.mp3", &Metadata{Artist: "Bar", Title: "B", Album: "Y"})
+
+	inodes := func(fs *FS, path string) uint64 {
+		var attr fuse.Attr
+		if err := fs.lookup(path).Attr(ctx, &attr); err != nil {
+			t.Fatal(err)
+		}
+		return attr.Inode
+	}
+
+	fs1, fs2 := NewFS(), NewFS()
+	for _, e := range []*FileEntry{a, b} {
+		if err := fs1.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, e := range []*FileEntry{b, a} {
+		if err := fs2.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{QueryDir, "artistalbum/Foo", "artistalbum/Foo/X/A.mp3", "artist/Bar/B.mp3"} {
+		if inodes(fs1, path) != inodes(fs2, path) {
+			t.Fatal("inode differs for", path)
+		}
+	}
+
+	// A changed file gets a new inode, but its directory doesn't:
+	before, beforeDir := inodes(fs1, "artist/Foo/A.mp3"), inodes(fs1, "artist/Foo")
+	changed := *a
+	changed.File.Size++
+	if err := fs1.UpdateAudio(&changed); err != nil {
+		t.Fatal(err)
+	}
+	if inodes(fs1, "artist/Foo/A.mp3") == before {
+		t.Fatal("expected new inode for changed file")
+	}
+	if inodes(fs1, "artist/Foo") != beforeDir {
+		t.Fatal("expected same inode for directory")
+	}
+}
+
+func TestFSInodeCollision(t *testing.T) {
+	fs := NewFS()
+	first := fs.inode("a/b", nil)
+
+	// Pretend something else already has the hash of "a/c":
+	fs2 := NewFS()
+	hash := fs2.inode("a/c", nil)
+	fs.inodes[hash] = "other"
+
+	ino := fs.inode("a/c", nil)
+	if ino == hash || ino == first || ino <= rootInode {
+		t.Fatal("expected collision to be resolved, found", ino)
+	}
+	if fs.inode("a/c", nil) != ino {
+		t.Fatal("expected the same inode for the same path")
+	}
+}
+
+func TestFSNamesAreDeterministic(t *testing.T) {
+	entries := []*FileEntry{
+		testEntry("c.mp3", &Metadata{Artist: "Foo", Title: "Same"}),
+		testEntry("a.mp3", &Metadata{Artist: "Foo", Title: "Same"}),
+		testEntry("b.mp3", &Metadata{Artist: "Foo", Title: "Same"}),
+		testEntry("x/broken.mp3", nil),
+		testEntry("y/broken.mp3", nil),
+	}
+	entries[3].Err = "boom"
+	entries[4].Err = "boom"
+
+	names := func(fs *FS, path string) (out []string) {
+		for _, ent := range fs.lookup(path).(*dirNode).dirents() {
+			out = append(out, ent.Name)
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	fs1, fs2 := NewFS(), NewFS()
+	for i := range entries {
+		if err := fs1.AddAudio(entries[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs2.AddAudio(entries[len(entries)-1-i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range []string{"artist/Foo", ViewFailed} {
+		n1, n2 := names(fs1, path), names(fs2, path)
+		if fmt.Sprint(n1) != fmt.Sprint(n2) {
+			t.Fatal("names differ", n1, n2)
+		}
+	}
+	if fs1.lookup("artist/Foo/Same.mp3").(*fileNode).entry != entries[1] {
+		t.Fatal("expected first source path to get the unsuffixed name")
+	}
+	if fs1.lookup("artist/Foo/Same v3.mp3").(*fileNode).entry != entries[0] {
+		t.Fatal("expected last source path to get the last suffix")
+	}
+
+	// Removing a file renumbers the rest as if it was never there:
+	fs1.RemoveAudio(entries[1].File.FullPath())
+	if n := names(fs1, "artist/Foo"); fmt.Sprint(n) != "[Same v2.mp3 Same.mp3]" {
+		t.Fatal("unexpected names after removal", n)
+	}
+	if fs1.lookup("artist/Foo/Same.mp3").(*fileNode).entry != entries[2] {
+		t.Fatal("expected b.mp3 to take over the unsuffixed name")
+	}
+	for _, file := range fs1.nodes[entries[2].File.FullPath()] {
+		if file.parent == nil {
+			t.Fatal("expected renamed node to be recorded")
+		}
+	}
+}
+
+func TestFSMultipleArtists(t *testing.T) {
+	fs := NewFS()
+	e := testEntry("a.mp3", &Metadata{Artist: "A feat. B", Title: "T", Album: "X", Genre: "Jazz; Funk"})
+	if err := fs.AddAudio(e); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		"artist/A/T.mp3", "artist/B/T.mp3",
+		"genre/Jazz/A/T.mp3", "genre/Funk/B/T.mp3",
+		"artistalbum/A feat. B/X/T.mp3",
+	} {
+		if _, ok := fs.lookup(path).(*fileNode); !ok {
+			t.Fatal("expected file", path)
+		}
+	}
+
+	fs.RemoveAudio(e.File.FullPath())
+	if fs.lookup("artist") != nil || fs.lookup("genre") != nil {
+		t.Fatal("expected views to be pruned")
+	}
+}
+
+func TestFSGroupsNames(t *testing.T) {
+	fs := NewFS()
+	a := testEntry("a.mp3", &Metadata{Artist: "Beatles, The", Title: "A", Album: "Abbey Road", Track: 1, Tracks: 2})
+	b := testEntry("b.mp3", &Metadata{Artist: "The Beatles", Title: "B", Album: "abbey road", Track: 2, Tracks: 2})
+	c := testEntry("c.mp3", &Metadata{Artist: "the  beatles", Title: "C", Album: "Let It Be"})
+	d := testEntry("d.mp3", &Metadata{Artist: "The Beatles", Title: "D", Album: "Let It Be"})
+	for _, e := range []*FileEntry{a, b, c} {
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every spelling is as common as the others, so the one that sorts first
+	// wins:
+	if names := dirNames(fs, "artist"); len(names) != 1 || names[0] != "Beatles, The" {
+		t.Fatal(names)
+	}
+	if fs.lookup("complete/Beatles, The/Abbey Road/02 B.mp3") == nil {
+		t.Fatal("expected complete album despite differently spelt tags")
+	}
+
+	// Now there's a most common spelling, everything moves:
+	if err := fs.AddAudio(d); err != nil {
+		t.Fatal(err)
+	}
+	if names := dirNames(fs, "artist"); len(names) != 1 || names[0] != "The Beatles" {
+		t.Fatal(names)
+	}
+	for _, path := range []string{"artist/The Beatles/A.mp3", "artistalbum/The Beatles/Let It Be/C.mp3", "complete/The Beatles/Abbey Road/01 A.mp3"} {
+		if fs.lookup(path) == nil {
+			t.Fatal("expected", path)
+		}
+	}
+
+	// And back again:
+	fs.RemoveAudio(d.File.FullPath())
+	if names := dirNames(fs, "artist"); len(names) != 1 || names[0] != "Beatles, The" {
+		t.Fatal(names)
+	}
+}
+
+func TestFSAliases(t *testing.T) {
+	aliases, err := ParseAliases("a.json", []byte(`{"artist": {"Prince": ["The Artist"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFS()
+	fs.SetAliases(aliases)
+	for _, e := range []*FileEntry{
+		testEntry("a.mp3", &Metadata{Artist: "The Artist", Title: "A"}),
+		testEntry("b.mp3", &Metadata{Artist: "the artist", Title: "B"}),
+	} {
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names := dirNames(fs, "artist"); len(names) != 1 || names[0] != "Prince" {
+		t.Fatal(names)
+	}
+}
+
+func dirNames(fs *FS, path string) (names []string) {
+	dir, _ := fs.lookup(path).(*dirNode)
+	if dir == nil {
+		return nil
+	}
+	for _, ent := range dir.dirents() {
+		names = append(names, ent.Name)
+	}
+	sort.Strings(names)
+	return names
+}
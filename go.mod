@@ -1,18 +1,22 @@
 module github.com/shabbyrobe/musefuse
 
-go 1.14
+go 1.18
 
 require (
 	bazil.org/fuse v0.0.0-20180421153158-65cc252bf669
 	github.com/NYTimes/gziphandler v1.1.0
 	github.com/davecgh/go-spew v1.1.1
 	github.com/dhowden/tag v0.0.0-20181104225729-a9f04c2798ca
-	github.com/pkg/errors v0.8.1 // indirect
-	github.com/pkg/profile v1.2.1 // indirect
 	github.com/shabbyrobe/cmdy v0.3.1
 	github.com/shabbyrobe/go-service v0.0.0-20180818001217-4987d2d6cede
 	github.com/shabbyrobe/golib/httptools v0.0.0-20200215043040-abc96c0fc869
 	github.com/shabbyrobe/golib/pathtools v0.0.0-20200215043040-abc96c0fc869
+	golang.org/x/text v0.16.0
+)
+
+require (
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/pkg/profile v1.2.1 // indirect
 	golang.org/x/net v0.0.0-20190213061140-3a22650c66bd // indirect
 	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
 )
@@ -0,0 +1,232 @@
+package musefuse
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// IndexVersion must be incremented whenever the serialised form of FileEntry
+// or Metadata changes, or whenever the way a FileEntry is derived from a file
+// changes. Indexes written with a different version are discarded and rebuilt.
+const IndexVersion = 7
+
+const indexMagic = "musefuse-index"
+
+type indexHeader struct {
+	Magic   string
+	Version int
+}
+
+// Index is a persistent cache of FileEntry values, keyed by the full path to
+// the source file. Entries are only considered valid if the Size and ModTime
+// of the FileInfo match the file currently on disk, so a remount only needs to
+// parse new or changed files.
+//
+// The on-disk format is a gzipped stream of JSON values; the first is an
+// indexHeader, each subsequent value is a FileEntry.
+type Index struct {
+	path    string
+	lock    sync.Mutex
+	entries map[string]*FileEntry
+	dirty   bool
+}
+
+// OpenIndex loads the index at path. If the file does not exist, or it was
+// written by an incompatible version, an empty index is returned that will be
+// written to path by Save.
+func OpenIndex(path string) (*Index, error) {
+	idx := &Index{
+		path:    path,
+		entries: map[string]*FileEntry{},
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ok, err := idx.read(f)
+	if err != nil {
+		return nil, fmt.Errorf("musefuse: could not read index %q: %w", path, err)
+	}
+	if !ok {
+		// Stale version, start again from scratch:
+		idx.entries = map[string]*FileEntry{}
+		idx.dirty = true
+	}
+
+	return idx, nil
+}
+
+func (idx *Index) read(rdr io.Reader) (ok bool, err error) {
+	gz, err := gzip.NewReader(bufio.NewReader(rdr))
+	if err != nil {
+		return false, err
+	}
+	defer gz.Close()
+
+	dec := json.NewDecoder(gz)
+
+	var hdr indexHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return false, err
+	}
+	if hdr.Magic != indexMagic {
+		return false, fmt.Errorf("unexpected magic %q", hdr.Magic)
+	}
+	if hdr.Version != IndexVersion {
+		return false, nil
+	}
+
+	for {
+		var entry FileEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return false, err
+		}
+		idx.entries[entry.File.FullPath()] = &entry
+	}
+
+	return true, nil
+}
+
+// Lookup returns a copy of the cached entry for file, or nil if there is no
+// entry or the file has changed since the entry was stored. The copy's File is
+// file, as the database it was found in may have been renamed since.
+func (idx *Index) Lookup(file FileInfo) *FileEntry {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	entry := idx.entries[file.FullPath()]
+	if entry == nil {
+		return nil
+	}
+	if entry.File.Size != file.Size || !entry.File.ModTime.Equal(file.ModTime) {
+		return nil
+	}
+	found := *entry
+	found.File = file
+	return &found
+}
+
+// Put adds or replaces the entry for entry.File. A copy of entry is stored, so
+// it can be handed to an FS without anything the FS does to it ending up in
+// the index.
+//
+// Entries with Err set aren't stored, and replace nothing but remove any entry
+// already there, as the error may not happen next time: the file may have
+// been read while it was still being copied, say.
+func (idx *Index) Put(entry *FileEntry) {
+	if entry.Err != "" {
+		idx.Remove(entry.File.FullPath())
+		return
+	}
+	stored := *entry
+	idx.lock.Lock()
+	idx.entries[entry.File.FullPath()] = &stored
+	idx.dirty = true
+	idx.lock.Unlock()
+}
+
+// Remove discards the entry for the file at the full path key, if present.
+func (idx *Index) Remove(key string) {
+	idx.lock.Lock()
+	if _, ok := idx.entries[key]; ok {
+		delete(idx.entries, key)
+		idx.dirty = true
+	}
+	idx.lock.Unlock()
+}
+
+// Retain discards every entry that does not correspond to one of files, so
+// that deleted files do not accumulate in the index forever.
+func (idx *Index) Retain(files []FileInfo) {
+	keep := make(map[string]bool, len(files))
+	for _, file := range files {
+		keep[file.FullPath()] = true
+	}
+
+	idx.lock.Lock()
+	for key := range idx.entries {
+		if !keep[key] {
+			delete(idx.entries, key)
+			idx.dirty = true
+		}
+	}
+	idx.lock.Unlock()
+}
+
+// Len returns the number of entries in the index.
+func (idx *Index) Len() int {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	return len(idx.entries)
+}
+
+// Save writes the index to disk if it has changed since it was opened. The
+// file is written to a temporary file first and renamed into place so a crash
+// can't leave a truncated index behind.
+func (idx *Index) Save() (rerr error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if !idx.dirty {
+		return nil
+	}
+
+	dir := filepath.Dir(idx.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, filepath.Base(idx.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	buf := bufio.NewWriter(f)
+	gz := gzip.NewWriter(buf)
+	enc := json.NewEncoder(gz)
+
+	if err := enc.Encode(indexHeader{Magic: indexMagic, Version: IndexVersion}); err != nil {
+		return err
+	}
+	for _, entry := range idx.entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), idx.path); err != nil {
+		return err
+	}
+
+	idx.dirty = false
+	return nil
+}
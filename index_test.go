@@ -0,0 +1,99 @@
+package musefuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIndexRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "musefuse-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "index.json.gz")
+	idx, err := OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2019, 1, 2, 3, 4, 5, 6, time.UTC)
+	file := FileInfo{Prefix: "/music", Path: "a/b.mp3", Size: 100, ModTime: mtime, Kind: FileAudio}
+	idx.Put(&FileEntry{File: file, Metadata: &Metadata{Title: "yep"}})
+	if err := idx.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := idx.Lookup(file)
+	if entry == nil || entry.Metadata.Title != "yep" {
+		t.Fatal("entry not found after reload", entry)
+	}
+
+	changed := file
+	changed.Size++
+	if idx.Lookup(changed) != nil {
+		t.Fatal("changed size should invalidate entry")
+	}
+
+	changed = file
+	changed.ModTime = mtime.Add(time.Second)
+	if idx.Lookup(changed) != nil {
+		t.Fatal("changed modtime should invalidate entry")
+	}
+
+	idx.Retain(nil)
+	if idx.Lookup(file) != nil {
+		t.Fatal("retain should have discarded entry")
+	}
+}
+
+func TestIndexCopiesEntries(t *testing.T) {
+	idx, err := OpenIndex(filepath.Join(os.TempDir(), "musefuse-nonexistent", "index.json.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := FileInfo{Prefix: "/music", Path: "a/b.mp3", Size: 100, Kind: FileAudio}
+	entry := &FileEntry{File: file, Metadata: &Metadata{Title: "yep"}}
+	idx.Put(entry)
+
+	// What happens to the entry after it is stored stays out of the index:
+	entry.Err = "placement failed"
+	found := idx.Lookup(file)
+	if found == nil || found == entry || found.Err != "" {
+		t.Fatal("expected a copy of the stored entry", found)
+	}
+	found.Err = "nope"
+	if idx.Lookup(file).Err != "" {
+		t.Fatal("expected lookup to return a copy")
+	}
+
+	// The database comes from the config, not the index:
+	renamed := file
+	renamed.Database = "renamed"
+	if found := idx.Lookup(renamed); found == nil || found.File.Database != "renamed" {
+		t.Fatal("expected lookup to use the database it was passed", found)
+	}
+}
+
+func TestIndexSkipsFailedEntries(t *testing.T) {
+	idx, err := OpenIndex(filepath.Join(os.TempDir(), "musefuse-nonexistent", "index.json.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := FileInfo{Prefix: "/music", Path: "a/b.mp3", Size: 100, Kind: FileAudio}
+	idx.Put(&FileEntry{File: file, Metadata: &Metadata{Title: "yep"}})
+	idx.Put(&FileEntry{File: file, Err: "unexpected EOF"})
+	if found := idx.Lookup(file); found != nil {
+		t.Fatal("expected failed entry to be parsed again next time", found)
+	}
+}
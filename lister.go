@@ -5,7 +5,9 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/shabbyrobe/golib/pathtools"
@@ -13,11 +15,17 @@ import (
 )
 
 type FileInfo struct {
-	Prefix  string
-	Path    string
-	Size    int64
-	ModTime time.Time
-	Kind    FileKind
+	Database string
+	Prefix   string
+	Path     string
+	Size     int64
+	ModTime  time.Time
+	Kind     FileKind
+}
+
+// FullPath returns the location of the file on disk.
+func (info FileInfo) FullPath() string {
+	return filepath.Join(info.Prefix, info.Path)
 }
 
 type FileKind string
@@ -25,99 +33,294 @@ type FileKind string
 const (
 	FileAudio    FileKind = "audio"
 	FilePlaylist FileKind = "playlist"
+
+	// FileSidecar is a file that belongs with the audio files next to it,
+	// like a cue sheet, rip log or lyrics.
+	FileSidecar FileKind = "sidecar"
 )
 
+// Database is a named collection of paths to search for music, along with
+// the rules for what to find there.
+type Database struct {
+	Name               string
+	Paths              []string
+	AudioExtensions    []string
+	PlaylistExtensions []string
+	SidecarExtensions  []string
+
+	// Ignore contains glob patterns (as per filepath.Match) for files and
+	// directories to skip. Patterns containing a slash are matched against the
+	// slash-separated path relative to the database path, other patterns are
+	// matched against the file or directory name.
+	Ignore []string
+}
+
 // Lister, if you touch that guitar, I'll remove the E-string and garotte you
 // with it.
 type Lister struct {
+	databases []*listerDatabase
+}
+
+type listerDatabase struct {
+	name             string
 	paths            []string
 	audioExtIndex    map[string]bool
 	playlistExtIndex map[string]bool
+	sidecarExtIndex  map[string]bool
+	ignore           []string
 }
 
 func NewLister(paths []string, audioExts, playlistExts []string) *Lister {
-	audioExtIndex := make(map[string]bool, len(audioExts))
-	for _, ext := range audioExts {
-		audioExtIndex[strings.ToLower(ext)] = true
+	lister, _ := NewDatabaseLister([]Database{{
+		Paths:              paths,
+		AudioExtensions:    audioExts,
+		PlaylistExtensions: playlistExts,
+	}})
+	return lister
+}
+
+func NewDatabaseLister(databases []Database) (*Lister, error) {
+	lister := &Lister{}
+
+	for _, db := range databases {
+		audioExtIndex := make(map[string]bool, len(db.AudioExtensions))
+		for _, ext := range db.AudioExtensions {
+			audioExtIndex[strings.ToLower(ext)] = true
+		}
+		playlistExtIndex := make(map[string]bool, len(db.PlaylistExtensions))
+		for _, ext := range db.PlaylistExtensions {
+			playlistExtIndex[strings.ToLower(ext)] = true
+		}
+		sidecarExtIndex := make(map[string]bool, len(db.SidecarExtensions))
+		for _, ext := range db.SidecarExtensions {
+			sidecarExtIndex[strings.ToLower(ext)] = true
+		}
+		for _, pattern := range db.Ignore {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("musefuse: database %q has invalid ignore pattern %q: %w", db.Name, pattern, err)
+			}
+		}
+
+		lister.databases = append(lister.databases, &listerDatabase{
+			name:             db.Name,
+			paths:            db.Paths,
+			audioExtIndex:    audioExtIndex,
+			playlistExtIndex: playlistExtIndex,
+			sidecarExtIndex:  sidecarExtIndex,
+			ignore:           db.Ignore,
+		})
+	}
+
+	return lister, nil
+}
+
+// Paths returns every path searched by the lister.
+func (lister *Lister) Paths() []string {
+	var paths []string
+	for _, db := range lister.databases {
+		paths = append(paths, db.paths...)
+	}
+	return paths
+}
+
+// ignored reports whether path, or any directory between root and path,
+// matches one of the database's ignore patterns.
+func (db *listerDatabase) ignored(root, path string) bool {
+	if len(db.ignore) == 0 {
+		return false
 	}
-	playlistExtIndex := make(map[string]bool, len(playlistExts))
-	for _, ext := range playlistExts {
-		playlistExtIndex[strings.ToLower(ext)] = true
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
 	}
 
-	return &Lister{
-		audioExtIndex:    audioExtIndex,
-		playlistExtIndex: playlistExtIndex,
-		paths:            paths,
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i, name := range parts {
+		dir := strings.Join(parts[:i+1], "/")
+		for _, pattern := range db.ignore {
+			subject := name
+			if strings.Contains(pattern, "/") {
+				subject = dir
+			}
+			if ok, _ := filepath.Match(pattern, subject); ok {
+				return true
+			}
+		}
 	}
+	return false
 }
 
 // Lister, don't be a gimboid!
 var fileGarbagePattern = regexp.MustCompile(`(?i)[/\\].AppleDouble[/\\]`)
 
+// List returns every file beneath the lister's paths, sorted by Prefix, then
+// Path, so that the order is the same from one run to the next.
 func (lister *Lister) List(into []FileInfo) (files []FileInfo, err error) {
 	files = into[:0]
 
-	for _, database := range lister.paths {
-		database, err = filepath.Abs(database)
-		if err != nil {
-			return nil, err
-		}
+	if err := lister.Walk(func(info FileInfo) error {
+		files = append(files, info)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 
-		if err := fastwalk.Walk(database, func(path string, typ os.FileMode) error {
-			if typ.IsDir() {
-				return nil
-			}
+	sortFiles(files)
+	return files, nil
+}
 
-			var kind FileKind
-			if lister.audioExtIndex[strings.ToLower(filepath.Ext(path))] {
-				kind = FileAudio
-			} else if lister.playlistExtIndex[strings.ToLower(filepath.Ext(path))] {
-				kind = FilePlaylist
-			} else {
-				return nil
-			}
+// Walk calls fn for each file beneath the lister's paths as soon as it is
+// found. The directory tree is walked by many goroutines at once, so the order
+// in which files are passed to fn is not defined, but fn is never called
+// concurrently. If fn returns an error, the walk stops and Walk returns it.
+func (lister *Lister) Walk(fn func(info FileInfo) error) (err error) {
+	var lock sync.Mutex
 
-			if filepath.Base(path)[0] == '.' {
-				return nil
-			}
-			if fileGarbagePattern.MatchString(path) {
-				return nil
+	for _, db := range lister.databases {
+		for _, root := range db.paths {
+			root, err = filepath.Abs(root)
+			if err != nil {
+				return err
 			}
 
-			fullPath, err := filepath.Abs(path)
-			if err != nil {
+			if err := fastwalk.Walk(root, func(path string, typ os.FileMode) error {
+				if typ.IsDir() {
+					if path != root && db.ignored(root, path) {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+
+				info, ok, err := db.fileInfo(root, path)
+				if err != nil {
+					return err
+				} else if !ok {
+					return nil
+				}
+
+				lock.Lock()
+				defer lock.Unlock()
+				return fn(info)
+
+			}); err != nil {
 				return err
 			}
+		}
+	}
+
+	return nil
+}
 
-			ok, filePrefix, filePath, err := pathtools.FilepathPrefix(fullPath, database)
+// Stat returns the FileInfo for a single file beneath one of the lister's
+// paths. If the file is not one that List would have returned, ok is false.
+func (lister *Lister) Stat(path string) (info FileInfo, ok bool, err error) {
+	fullPath, err := filepath.Abs(path)
+	if err != nil {
+		return info, false, err
+	}
+
+	for _, db := range lister.databases {
+		for _, root := range db.paths {
+			root, err = filepath.Abs(root)
 			if err != nil {
-				return err
+				return info, false, err
 			}
-			if !ok {
-				return fmt.Errorf("musefuse: could not separate path %q from prefix %q", fullPath, database)
+			if inside, _, _, err := pathtools.FilepathPrefix(fullPath, root); err != nil {
+				return info, false, err
+			} else if inside {
+				return db.fileInfo(root, fullPath)
 			}
+		}
+	}
 
-			st, err := os.Stat(fullPath)
+	return info, false, nil
+}
+
+// ignoredDir reports whether Walk skips the directory at path, which is
+// beneath one of the lister's paths.
+func (lister *Lister) ignoredDir(path string) bool {
+	fullPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	for _, db := range lister.databases {
+		for _, root := range db.paths {
+			root, err = filepath.Abs(root)
 			if err != nil {
-				return err
+				return false
 			}
-
-			info := FileInfo{
-				Kind:    kind,
-				Prefix:  filePrefix,
-				Path:    filePath,
-				ModTime: st.ModTime(),
-				Size:    st.Size(),
+			if inside, _, _, err := pathtools.FilepathPrefix(fullPath, root); err == nil && inside {
+				return fullPath != root && db.ignored(root, fullPath)
 			}
-			files = append(files, info)
+		}
+	}
+	return false
+}
 
-			return nil
+func (db *listerDatabase) fileInfo(database string, path string) (info FileInfo, ok bool, err error) {
+	var kind FileKind
+	if db.audioExtIndex[strings.ToLower(filepath.Ext(path))] {
+		kind = FileAudio
+	} else if db.playlistExtIndex[strings.ToLower(filepath.Ext(path))] {
+		kind = FilePlaylist
+	} else if db.sidecarExtIndex[strings.ToLower(filepath.Ext(path))] {
+		kind = FileSidecar
+	} else {
+		return info, false, nil
+	}
 
-		}); err != nil {
-			return nil, err
-		}
+	if filepath.Base(path)[0] == '.' {
+		return info, false, nil
+	}
+	if fileGarbagePattern.MatchString(path) {
+		return info, false, nil
+	}
+	if db.ignored(database, path) {
+		return info, false, nil
+	}
+
+	fullPath, err := filepath.Abs(path)
+	if err != nil {
+		return info, false, err
+	}
+
+	ok, filePrefix, filePath, err := pathtools.FilepathPrefix(fullPath, database)
+	if err != nil {
+		return info, false, err
+	}
+	if !ok {
+		return info, false, fmt.Errorf("musefuse: could not separate path %q from prefix %q", fullPath, database)
 	}
 
-	return files, err
+	st, err := os.Stat(fullPath)
+	if err != nil {
+		return info, false, err
+	}
+	if st.IsDir() {
+		return info, false, nil
+	}
+
+	info = FileInfo{
+		Database: db.name,
+		Kind:     kind,
+		Prefix:   filePrefix,
+		Path:     filePath,
+		ModTime:  st.ModTime(),
+		Size:     st.Size(),
+	}
+	return info, true, nil
+}
+
+func sortFiles(files []FileInfo) {
+	sort.Slice(files, func(i, j int) bool {
+		return fileLess(files[i], files[j])
+	})
+}
+
+func fileLess(a, b FileInfo) bool {
+	if a.Prefix != b.Prefix {
+		return a.Prefix < b.Prefix
+	}
+	return a.Path < b.Path
 }
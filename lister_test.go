@@ -0,0 +1,42 @@
+package musefuse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestListerListIsSorted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "musefuse-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"z/1.mp3", "a/2.flac", "a/b/3.ogg", "m/4.xspf", "m/.hidden.mp3", "m/notes.txt",
+		"c/5.mp3", "c/6.mp3", "c/7.mp3", "d/8.mp3", "e/9.mp3",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lister := NewLister([]string{dir}, AudioExtensions, PlaylistExtensions)
+	files, err := lister.List(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 9 {
+		t.Fatal("unexpected files", files)
+	}
+	if !sort.SliceIsSorted(files, func(i, j int) bool { return fileLess(files[i], files[j]) }) {
+		t.Fatal("files not sorted", files)
+	}
+}
@@ -1,13 +1,16 @@
 package musefuse
 
 import (
+	"os"
 	"strings"
+	"time"
 
 	"github.com/dhowden/tag"
 )
 
 var AudioExtensions = []string{".oga", ".mp3", ".ogg", ".opus", ".flac", ".mp4", ".m4a", ".alac", ".aac"}
-var PlaylistExtensions = []string{".xspf"}
+var PlaylistExtensions = []string{".xspf", ".m3u", ".m3u8", ".pls", ".wpl"}
+var SidecarExtensions = []string{".cue", ".log", ".lrc", ".pdf", ".txt"}
 
 // Metadata is a structured representation of the tag.Metadata interface for
 // serialisation.
@@ -24,14 +27,43 @@ type Metadata struct {
 	Lyrics      string
 	Comment     string
 
+	// Artists and Genres are set if the file stores more than one artist or
+	// genre as separate values, in which case Artist and Genre are the first
+	// of them. See ArtistValues and GenreValues, which also split on
+	// delimiters like ";".
+	Artists []string
+	Genres  []string
+
 	Track  int
 	Tracks int
 
 	Disc  int
 	Discs int
 
-	// Picture returns a picture, or nil if not available.
-	Picture *tag.Picture
+	// Picture describes the embedded picture, or is nil if not available.
+	// Picture.Data is not kept as it is far too big to hold in memory (or the
+	// Index) for every file; use LoadPicture to read it from the file.
+	Picture     *tag.Picture
+	PictureSize int
+
+	// The properties of the audio stream, which are read by ProbeAudio rather
+	// than from the tags. Bitrate is in kbit/s, and is the average for VBR
+	// files. They are zero if unknown.
+	Codec         string
+	Lossless      bool
+	Duration      time.Duration
+	Bitrate       int
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+
+	// TrackGain and AlbumGain are the file's ReplayGain tags, or nil if it
+	// doesn't have them. Opus R128 gains are converted to ReplayGain's
+	// reference level.
+	TrackGain *ReplayGain
+	AlbumGain *ReplayGain
+
+	MusicBrainz MusicBrainzIDs
 
 	// Raw returns the raw mapping of retrieved tag names and associated values.
 	// NB: tag/atom names are not standardised between formats.
@@ -57,23 +89,73 @@ func MetadataFromTag(tagData tag.Metadata) *Metadata {
 		Composer:    strings.TrimSpace(tagData.Composer()),
 		Genre:       strings.TrimSpace(tagData.Genre()),
 		Year:        tagData.Year(),
-		Picture:     tagData.Picture(),
 		Lyrics:      tagData.Lyrics(),
 		Comment:     strings.TrimSpace(tagData.Comment()),
 	}
 	m.Track, m.Tracks = tagData.Track()
 	m.Disc, m.Discs = tagData.Disc()
 
+	if pic := tagData.Picture(); pic != nil {
+		m.Picture = &tag.Picture{
+			Ext:         pic.Ext,
+			MIMEType:    pic.MIMEType,
+			Type:        pic.Type,
+			Description: pic.Description,
+		}
+		m.PictureSize = len(pic.Data)
+	}
+
 	// FIXME: deep copy:
 	srcRaw := tagData.Raw()
 	m.Raw = make(map[string]interface{}, len(srcRaw))
 	for k, v := range srcRaw {
+		if _, ok := v.(*tag.Picture); ok {
+			continue // See Metadata.Picture
+		}
 		m.Raw[k] = v
 	}
+	m.TrackGain, m.AlbumGain = replayGainFromRaw(m.Raw)
+	m.MusicBrainz = musicBrainzFromRaw(m.Raw)
 
 	return m
 }
 
+// LoadPicture reads the embedded picture from the audio file at path, or
+// returns nil if it doesn't have one.
+func LoadPicture(path string) (*tag.Picture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tagData, err := tag.ReadFrom(f)
+	if err != nil {
+		return nil, err
+	}
+	return tagData.Picture(), nil
+}
+
+// PictureExt returns the file extension, including the '.', for pic.
+func PictureExt(pic *tag.Picture) string {
+	switch strings.ToLower(pic.MIMEType) {
+	case "image/jpeg", "image/jpg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/bmp":
+		return ".bmp"
+	case "image/webp":
+		return ".webp"
+	}
+	if pic.Ext != "" {
+		return "." + strings.TrimPrefix(strings.ToLower(pic.Ext), ".")
+	}
+	return ".jpg"
+}
+
 type metadataAdapter struct {
 	inner *Metadata
 }
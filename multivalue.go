@@ -0,0 +1,567 @@
+package musefuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/dhowden/tag"
+)
+
+// DefaultTagDelimiters split a single artist or genre tag into several values.
+// "/" is not included as it would split "AC/DC".
+var DefaultTagDelimiters = []string{";", " feat. ", " ft. "}
+
+// maxTagBlock limits how much of a file is read looking for tag values, in
+// case it is corrupt. Embedded pictures can make comment blocks quite big.
+const maxTagBlock = 64 << 20
+
+// ReadMetadata reads the tags from r, including the values for repeated Vorbis
+// comments and null-separated ID3v2.4 frames, which tag.ReadFrom overwrites or
+// joins together (see Metadata.Artists), and the audio properties; see
+// ProbeAudio.
+func ReadMetadata(r io.ReadSeeker) (*Metadata, error) {
+	tagData, err := tag.ReadFrom(r)
+	if err != nil {
+		// tag.ReadFrom only understands Ogg Vorbis, so other Ogg files, like
+		// Opus, are read from their comment header instead:
+		if _, serr := r.Seek(0, io.SeekStart); serr != nil {
+			return nil, err
+		}
+		values, oerr := readOggValues(r)
+		if oerr != nil {
+			return nil, err
+		}
+		tagData = oggTags(values)
+	}
+	meta := MetadataFromTag(tagData)
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// The tags were readable, so a file this can't make sense of still gets
+	// the values from tag.ReadFrom:
+	values, _ := readTagValues(r, meta)
+	if artists := values["artist"]; len(artists) > 1 {
+		meta.Artists = artists
+		meta.Artist = artists[0]
+	}
+	if genres := values["genre"]; len(genres) > 1 {
+		meta.Genres = genres
+		meta.Genre = genres[0]
+	}
+	if ids := values["musicbrainz_artistid"]; len(ids) > 1 {
+		meta.MusicBrainz.Artists = parseMusicBrainzIDs(strings.Join(ids, ";"))
+	}
+	if ids := values["musicbrainz_albumartistid"]; len(ids) > 1 {
+		meta.MusicBrainz.AlbumArtists = parseMusicBrainzIDs(strings.Join(ids, ";"))
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	_ = ProbeAudio(r, meta)
+	return meta, nil
+}
+
+// ArtistValues returns every artist for the file, splitting the artist tags
+// on delimiters. The first value is the primary artist.
+func (meta *Metadata) ArtistValues(delimiters []string) []string {
+	if len(meta.Artists) > 0 {
+		return splitTagValues(meta.Artists, delimiters)
+	}
+	return splitTagValues([]string{meta.Artist}, delimiters)
+}
+
+// GenreValues returns every genre for the file, splitting the genre tags on
+// delimiters. The first value is the primary genre.
+func (meta *Metadata) GenreValues(delimiters []string) []string {
+	if len(meta.Genres) > 0 {
+		return splitTagValues(meta.Genres, delimiters)
+	}
+	return splitTagValues([]string{meta.Genre}, delimiters)
+}
+
+// splitTagValues splits each of values on any of delimiters, which are
+// matched case insensitively, and removes empty and duplicate values.
+func splitTagValues(values []string, delimiters []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	add := func(v string) {
+		v = strings.TrimSpace(v)
+		if v != "" && !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+
+	for _, value := range values {
+		start := 0
+		for i := 0; i < len(value); i++ {
+			for _, delim := range delimiters {
+				if delim != "" && i+len(delim) <= len(value) && strings.EqualFold(value[i:i+len(delim)], delim) {
+					add(value[start:i])
+					start = i + len(delim)
+					i = start - 1
+					break
+				}
+			}
+		}
+		add(value[start:])
+	}
+	return out
+}
+
+// readTagValues returns every value for the "artist" and "genre" tags in r,
+// in the order they appear, for the formats that can store more than one.
+func readTagValues(r io.ReadSeeker, meta *Metadata) (map[string][]string, error) {
+	switch {
+	case meta.FileType == tag.FLAC:
+		return readFLACValues(r)
+	case meta.FileType == tag.OGG:
+		return readOggValues(r)
+	case meta.Format == tag.ID3v2_2 || meta.Format == tag.ID3v2_3 || meta.Format == tag.ID3v2_4:
+		return readID3Values(r)
+	}
+	return nil, nil
+}
+
+var errTagBlockSize = errors.New("musefuse: tag block too big")
+
+func readBlock(r io.Reader, size int) ([]byte, error) {
+	if size < 0 || size > maxTagBlock {
+		return nil, errTagBlockSize
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// skipID3 skips an ID3v2 tag at the start of r, if there is one.
+func skipID3(r io.ReadSeeker) error {
+	var hdr [10]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if string(hdr[:3]) != "ID3" {
+		_, err := r.Seek(-10, io.SeekCurrent)
+		return err
+	}
+	size := syncsafe(hdr[6:10])
+	if hdr[5]&0x10 != 0 {
+		size += 10 // Footer
+	}
+	_, err := r.Seek(int64(size), io.SeekCurrent)
+	return err
+}
+
+func readFLACValues(r io.ReadSeeker) (map[string][]string, error) {
+	if err := skipID3(r); err != nil {
+		return nil, err
+	}
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+	if string(magic[:]) != "fLaC" {
+		return nil, fmt.Errorf("musefuse: expected 'fLaC', found %q", magic)
+	}
+
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		last, typ := hdr[0]&0x80 != 0, hdr[0]&0x7f
+		size := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+
+		if typ == 4 { // VORBIS_COMMENT
+			block, err := readBlock(r, size)
+			if err != nil {
+				return nil, err
+			}
+			return parseVorbisComments(block)
+		}
+		if last {
+			return nil, nil
+		}
+		if _, err := r.Seek(int64(size), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readOggValues reads the comment header, which is the second packet of the
+// first logical stream, from an Ogg Vorbis or Opus file.
+func readOggValues(r io.Reader) (map[string][]string, error) {
+	var packet []byte
+	var packets int
+	var serial uint32
+
+	for page := 0; ; page++ {
+		var hdr [27]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		if string(hdr[:4]) != "OggS" {
+			return nil, fmt.Errorf("musefuse: expected 'OggS', found %q", hdr[:4])
+		}
+		pageSerial := binary.LittleEndian.Uint32(hdr[14:18])
+		if page == 0 {
+			serial = pageSerial
+		}
+
+		segments, err := readBlock(r, int(hdr[26]))
+		if err != nil {
+			return nil, err
+		}
+		for _, seg := range segments {
+			data, err := readBlock(r, int(seg))
+			if err != nil {
+				return nil, err
+			}
+			if pageSerial != serial {
+				continue
+			}
+			if packets == 1 {
+				if len(packet)+len(data) > maxTagBlock {
+					return nil, errTagBlockSize
+				}
+				packet = append(packet, data...)
+			}
+			if seg < 255 {
+				packets++
+				if packets == 2 {
+					return parseOggComments(packet)
+				}
+			}
+		}
+	}
+}
+
+// oggTags adapts the comments read by readOggValues to tag.Metadata, for the
+// Ogg files tag.ReadFrom can't read. Embedded pictures are not supported.
+type oggTags map[string][]string
+
+func (t oggTags) get(keys ...string) string {
+	for _, key := range keys {
+		if v := t[key]; len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// numbers parses the number in key, which may be followed by the total, like
+// "3/12". That's common, though not standard.
+func (t oggTags) numbers(key string, totalKeys ...string) (n, total int) {
+	v := t.get(key)
+	if slash := strings.IndexByte(v, '/'); slash >= 0 {
+		total, _ = strconv.Atoi(strings.TrimSpace(v[slash+1:]))
+		v = v[:slash]
+	}
+	n, _ = strconv.Atoi(strings.TrimSpace(v))
+	if v, err := strconv.Atoi(t.get(totalKeys...)); err == nil {
+		total = v
+	}
+	return n, total
+}
+
+func (t oggTags) Format() tag.Format     { return tag.VORBIS }
+func (t oggTags) FileType() tag.FileType { return tag.OGG }
+func (t oggTags) Title() string          { return t.get("title") }
+func (t oggTags) Album() string          { return t.get("album") }
+func (t oggTags) Artist() string         { return t.get("artist", "performer") }
+func (t oggTags) AlbumArtist() string    { return t.get("albumartist", "album artist") }
+func (t oggTags) Composer() string       { return t.get("composer") }
+func (t oggTags) Genre() string          { return t.get("genre") }
+func (t oggTags) Lyrics() string         { return t.get("lyrics") }
+func (t oggTags) Comment() string        { return t.get("comment", "description") }
+func (t oggTags) Picture() *tag.Picture  { return nil }
+
+func (t oggTags) Year() int {
+	date := t.get("date", "year")
+	if len(date) < 4 {
+		return 0
+	}
+	year, _ := strconv.Atoi(date[:4])
+	return year
+}
+
+func (t oggTags) Track() (int, int) { return t.numbers("tracknumber", "tracktotal", "totaltracks") }
+func (t oggTags) Disc() (int, int)  { return t.numbers("discnumber", "disctotal", "totaldiscs") }
+
+func (t oggTags) Raw() map[string]interface{} {
+	raw := make(map[string]interface{}, len(t))
+	for k, v := range t {
+		raw[k] = v[len(v)-1] // As tag.ReadFrom does
+	}
+	return raw
+}
+
+func parseOggComments(packet []byte) (map[string][]string, error) {
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+		return parseVorbisComments(packet[7:])
+	case bytes.HasPrefix(packet, []byte("OpusTags")):
+		return parseVorbisComments(packet[8:])
+	}
+	return nil, fmt.Errorf("musefuse: unknown Ogg comment header")
+}
+
+// parseVorbisComments parses a Vorbis comment block, as found in FLAC and Ogg
+// files. Keys are lower case.
+func parseVorbisComments(block []byte) (map[string][]string, error) {
+	r := bytes.NewReader(block)
+	readString := func() (string, error) {
+		var n uint32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return "", err
+		}
+		if int64(n) > int64(r.Len()) {
+			return "", io.ErrUnexpectedEOF
+		}
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return string(buf), err
+	}
+
+	if _, err := readString(); err != nil { // Vendor
+		return nil, err
+	}
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+
+	values := map[string][]string{}
+	for i := uint32(0); i < count; i++ {
+		comment, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		eq := strings.IndexByte(comment, '=')
+		if eq < 0 {
+			continue
+		}
+		key := strings.ToLower(comment[:eq])
+		if value := strings.TrimSpace(comment[eq+1:]); value != "" {
+			values[key] = append(values[key], value)
+		}
+	}
+	return values, nil
+}
+
+// id3Frames maps the ID3v2 frames that are read by readID3Values to the keys
+// they are returned as.
+var id3Frames = map[string]string{
+	"TPE1": "artist", "TP1": "artist",
+	"TCON": "genre", "TCO": "genre",
+}
+
+func readID3Values(r io.Reader) (map[string][]string, error) {
+	var hdr [10]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if string(hdr[:3]) != "ID3" {
+		return nil, nil
+	}
+	version, flags := hdr[3], hdr[5]
+	tagData, err := readBlock(r, syncsafe(hdr[6:10]))
+	if err != nil {
+		return nil, err
+	}
+	if version < 4 && flags&0x80 != 0 {
+		tagData = unsynchronise(tagData)
+	}
+
+	if flags&0x40 != 0 && version >= 3 && len(tagData) >= 4 {
+		// Skip the extended header. Its size doesn't include itself in
+		// v2.3, but does in v2.4:
+		size := int(binary.BigEndian.Uint32(tagData[:4])) + 4
+		if version == 4 {
+			size = syncsafe(tagData[:4])
+		}
+		if size > len(tagData) {
+			return nil, nil
+		}
+		tagData = tagData[size:]
+	}
+
+	idLen, hdrLen := 4, 10
+	if version == 2 {
+		idLen, hdrLen = 3, 6
+	}
+
+	values := map[string][]string{}
+	for len(tagData) >= hdrLen && tagData[0] != 0 {
+		id := string(tagData[:idLen])
+		var size int
+		var frameFlags uint16
+		switch version {
+		case 2:
+			size = int(tagData[3])<<16 | int(tagData[4])<<8 | int(tagData[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(tagData[4:8]))
+			frameFlags = binary.BigEndian.Uint16(tagData[8:10])
+		default:
+			size = syncsafe(tagData[4:8])
+			frameFlags = binary.BigEndian.Uint16(tagData[8:10])
+		}
+		if size < 0 || hdrLen+size > len(tagData) {
+			break
+		}
+		frame := tagData[hdrLen : hdrLen+size]
+		tagData = tagData[hdrLen+size:]
+
+		key, ok := id3Frames[id]
+		if !ok {
+			continue
+		}
+		if version == 3 {
+			if frameFlags&0x00c0 != 0 { // Compressed or encrypted
+				continue
+			}
+			if frameFlags&0x0020 != 0 && len(frame) > 0 { // Grouping identity
+				frame = frame[1:]
+			}
+		} else if version == 4 {
+			if frameFlags&0x000c != 0 { // Compressed or encrypted
+				continue
+			}
+			if frameFlags&0x0040 != 0 && len(frame) > 0 { // Grouping identity
+				frame = frame[1:]
+			}
+			if frameFlags&0x0001 != 0 && len(frame) >= 4 { // Data length indicator
+				frame = frame[4:]
+			}
+			if frameFlags&0x0002 != 0 {
+				frame = unsynchronise(frame)
+			}
+		}
+
+		for _, value := range decodeID3Text(frame) {
+			if key == "genre" {
+				value = id3Genre(value)
+			}
+			if value != "" {
+				values[key] = append(values[key], value)
+			}
+		}
+	}
+	return values, nil
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// unsynchronise reverses the ID3v2 unsynchronisation scheme, which inserts a
+// zero after each 0xff.
+func unsynchronise(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xff && i+1 < len(b) && b[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
+
+// decodeID3Text decodes an ID3v2 text frame, which may contain several
+// null-separated values.
+func decodeID3Text(frame []byte) []string {
+	if len(frame) < 1 {
+		return nil
+	}
+	enc, data := frame[0], frame[1:]
+
+	var text string
+	switch enc {
+	case 1, 2: // UTF-16, with a BOM or big endian
+		if len(data) >= 2 && (data[0] == 0xff && data[1] == 0xfe || data[0] == 0xfe && data[1] == 0xff) {
+			// Each value may have its own BOM, so decode them separately:
+			var out []string
+			for _, part := range splitUTF16(data) {
+				out = append(out, decodeUTF16(part))
+			}
+			return trimValues(out)
+		}
+		text = decodeUTF16(data)
+	case 3: // UTF-8
+		text = string(data)
+	default: // ISO-8859-1
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+	return trimValues(strings.Split(text, "\x00"))
+}
+
+// splitUTF16 splits UTF-16 text on each null character.
+func splitUTF16(data []byte) [][]byte {
+	var parts [][]byte
+	start := 0
+	for i := 0; i+1 < len(data); i += 2 {
+		if data[i] == 0 && data[i+1] == 0 {
+			parts = append(parts, data[start:i])
+			start = i + 2
+		}
+	}
+	return append(parts, data[start:])
+}
+
+// decodeUTF16 decodes UTF-16 with an optional BOM, defaulting to big endian.
+func decodeUTF16(data []byte) string {
+	var order binary.ByteOrder = binary.BigEndian
+	if len(data) >= 2 {
+		if data[0] == 0xff && data[1] == 0xfe {
+			order, data = binary.LittleEndian, data[2:]
+		} else if data[0] == 0xfe && data[1] == 0xff {
+			data = data[2:]
+		}
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[i*2:])
+	}
+	return strings.Replace(string(utf16.Decode(units)), "\x00", "", -1)
+}
+
+func trimValues(values []string) []string {
+	out := values[:0]
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// id3Genre strips ID3v1 genre references like "(17)" from the front of a TCON
+// value. Values that are only a reference are dropped, so the genre name from
+// tag.Metadata.Genre is used for files with a single genre.
+func id3Genre(value string) string {
+	for strings.HasPrefix(value, "(") {
+		end := strings.IndexByte(value, ')')
+		if end < 0 || strings.Trim(value[1:end], "0123456789") != "" {
+			break
+		}
+		value = value[end+1:]
+	}
+	if strings.Trim(value, "0123456789") == "" {
+		return ""
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,137 @@
+package musefuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+)
+
+func vorbisComments(comments ...string) []byte {
+	var buf bytes.Buffer
+	put := func(s string) {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(s)))
+		buf.WriteString(s)
+	}
+	put("test")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(comments)))
+	for _, c := range comments {
+		put(c)
+	}
+	return buf.Bytes()
+}
+
+func TestSplitTagValues(t *testing.T) {
+	for idx, tc := range []struct {
+		in  []string
+		out []string
+	}{
+		{[]string{"A; B;C"}, []string{"A", "B", "C"}},
+		{[]string{"A Feat. B"}, []string{"A", "B"}},
+		{[]string{"AC/DC"}, []string{"AC/DC"}},
+		{[]string{"A", "B; A", " "}, []string{"A", "B"}},
+		{[]string{""}, nil},
+	} {
+		if out := splitTagValues(tc.in, DefaultTagDelimiters); !reflect.DeepEqual(out, tc.out) {
+			t.Fatal(idx, out)
+		}
+	}
+}
+
+func TestReadMetadataFLAC(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("fLaC")
+	buf.Write([]byte{0, 0, 0, 34}) // STREAMINFO
+	buf.Write(make([]byte, 34))
+
+	block := vorbisComments("TITLE=T", "ARTIST=A", "artist=B", "GENRE=Jazz")
+	buf.Write([]byte{0x80 | 4, 0, byte(len(block) >> 8), byte(len(block))})
+	buf.Write(block)
+
+	meta, err := ReadMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Artist != "A" || !reflect.DeepEqual(meta.Artists, []string{"A", "B"}) {
+		t.Fatal(meta.Artist, meta.Artists)
+	}
+	if meta.Genre != "Jazz" || meta.Genres != nil {
+		t.Fatal(meta.Genre, meta.Genres)
+	}
+}
+
+func TestReadOggValues(t *testing.T) {
+	page := func(serial uint32, packets ...[]byte) []byte {
+		var segs, data []byte
+		for _, p := range packets {
+			n := len(p)
+			for ; n >= 255; n -= 255 {
+				segs = append(segs, 255)
+			}
+			segs = append(segs, byte(n))
+			data = append(data, p...)
+		}
+		hdr := make([]byte, 27)
+		copy(hdr, "OggS")
+		binary.LittleEndian.PutUint32(hdr[14:], serial)
+		hdr[26] = byte(len(segs))
+		return append(append(hdr, segs...), data...)
+	}
+
+	// A big comment packet spans segments, and a page from another stream
+	// gets in the way:
+	comments := append([]byte("OpusTags"), vorbisComments("ARTIST=A", "ARTIST=B", "DESCRIPTION="+string(make([]byte, 300)))...)
+	var buf bytes.Buffer
+	buf.Write(page(1, []byte("OpusHead")))
+	buf.Write(page(2, []byte("other")))
+	buf.Write(page(1, comments))
+
+	values, err := readOggValues(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values["artist"], []string{"A", "B"}) {
+		t.Fatal(values)
+	}
+}
+
+func TestReadID3Values(t *testing.T) {
+	frame := func(id string, data []byte) []byte {
+		size := len(data)
+		hdr := []byte(id)
+		hdr = append(hdr, byte(size>>21&0x7f), byte(size>>14&0x7f), byte(size>>7&0x7f), byte(size&0x7f), 0, 0)
+		return append(hdr, data...)
+	}
+	utf16BOM := func(s string) []byte {
+		out := []byte{0xff, 0xfe}
+		for _, u := range utf16.Encode([]rune(s)) {
+			out = append(out, byte(u), byte(u>>8))
+		}
+		return out
+	}
+
+	var frames []byte
+	frames = append(frames, frame("TIT2", []byte("\x03Title"))...)
+	frames = append(frames, frame("TPE1", []byte("\x03A\x00B\x00"))...)
+	genre := append([]byte{1}, utf16BOM("(8)Jazz")...)
+	genre = append(genre, 0, 0)
+	genre = append(genre, utf16BOM("Funk")...)
+	frames = append(frames, frame("TCON", genre)...)
+	frames = append(frames, make([]byte, 10)...) // Padding
+
+	size := len(frames)
+	tag := []byte{'I', 'D', '3', 4, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	tag = append(tag, frames...)
+
+	values, err := readID3Values(bytes.NewReader(tag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values["artist"], []string{"A", "B"}) {
+		t.Fatal(values)
+	}
+	if !reflect.DeepEqual(values["genre"], []string{"Jazz", "Funk"}) {
+		t.Fatal(values)
+	}
+}
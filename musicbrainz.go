@@ -0,0 +1,105 @@
+package musefuse
+
+import (
+	"encoding/base64"
+	"regexp"
+	"strings"
+
+	"github.com/dhowden/tag"
+)
+
+// MusicBrainzIDs are the MusicBrainz identifiers a file is tagged with, by
+// Picard and the like. They are lower case UUIDs, or empty if not tagged.
+type MusicBrainzIDs struct {
+	Recording    string // MUSICBRAINZ_TRACKID, or the ID3v2 UFID
+	Track        string // MUSICBRAINZ_RELEASETRACKID
+	Release      string // MUSICBRAINZ_ALBUMID
+	ReleaseGroup string // MUSICBRAINZ_RELEASEGROUPID
+	Artists      []string
+	AlbumArtists []string
+}
+
+// musicBrainzProvider is the owner of the ID3v2 UFID frame holding the
+// recording ID.
+const musicBrainzProvider = "http://musicbrainz.org"
+
+var uuidPattern = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// musicBrainzKey normalises the name of a MusicBrainz tag, which is
+// "MUSICBRAINZ_ALBUMID" in Vorbis, but "MusicBrainz Album Id" in ID3v2 TXXX
+// frames and MP4 atoms.
+func musicBrainzKey(name string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "_", "").Replace(name))
+}
+
+// parseMusicBrainzIDs returns every UUID in s. Tags with several IDs separate
+// them with "; " or "/", or they run together when tag.ReadFrom joins the
+// values of an ID3v2.4 frame.
+func parseMusicBrainzIDs(s string) []string {
+	ids := uuidPattern.FindAllString(s, -1)
+	for i := range ids {
+		ids[i] = strings.ToLower(ids[i])
+	}
+	return ids
+}
+
+func firstMusicBrainzID(s string) string {
+	if ids := parseMusicBrainzIDs(s); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+// musicBrainzFromRaw finds the MusicBrainz IDs in raw.
+func musicBrainzFromRaw(raw map[string]interface{}) (ids MusicBrainzIDs) {
+	for key, v := range raw {
+		if provider, id, ok := rawUFID(v); ok {
+			if provider == musicBrainzProvider {
+				ids.Recording = firstMusicBrainzID(id)
+			}
+			continue
+		}
+		if desc, text, ok := rawDescription(v); ok {
+			key, v = desc, text
+		}
+		s, ok := rawTagString(v)
+		if !ok {
+			continue
+		}
+		switch musicBrainzKey(key) {
+		case "musicbrainztrackid":
+			if ids.Recording == "" {
+				ids.Recording = firstMusicBrainzID(s)
+			}
+		case "musicbrainzreleasetrackid":
+			ids.Track = firstMusicBrainzID(s)
+		case "musicbrainzalbumid":
+			ids.Release = firstMusicBrainzID(s)
+		case "musicbrainzreleasegroupid":
+			ids.ReleaseGroup = firstMusicBrainzID(s)
+		case "musicbrainzartistid":
+			ids.Artists = parseMusicBrainzIDs(s)
+		case "musicbrainzalbumartistid":
+			ids.AlbumArtists = parseMusicBrainzIDs(s)
+		}
+	}
+	return ids
+}
+
+// rawUFID returns the owner and identifier of a raw ID3v2 UFID frame, whether
+// it is a *tag.UFID, or a map after being loaded from the Index.
+func rawUFID(v interface{}) (provider string, id string, ok bool) {
+	switch v := v.(type) {
+	case *tag.UFID:
+		return v.Provider, string(v.Identifier), true
+	case map[string]interface{}:
+		provider, ok := v["Provider"].(string)
+		enc, _ := v["Identifier"].(string)
+		if !ok {
+			return "", "", false
+		}
+		bts, _ := base64.StdEncoding.DecodeString(enc)
+		return provider, string(bts), true
+	}
+	return "", "", false
+}
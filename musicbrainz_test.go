@@ -0,0 +1,49 @@
+package musefuse
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dhowden/tag"
+)
+
+func TestMusicBrainzFromRaw(t *testing.T) {
+	const (
+		id1 = "8f3471b5-7e6a-48da-86a9-c1c07a0f47ae"
+		id2 = "b10bbbfc-cf9e-42e0-be17-e2c3e1d2600d"
+	)
+	for idx, tc := range []struct {
+		raw map[string]interface{}
+		ids MusicBrainzIDs
+	}{
+		{ // Vorbis
+			raw: map[string]interface{}{"musicbrainz_albumid": id1, "musicbrainz_trackid": id2, "musicbrainz_artistid": id1 + "; " + id2},
+			ids: MusicBrainzIDs{Release: id1, Recording: id2, Artists: []string{id1, id2}},
+		},
+		{ // ID3v2, with a joined ID3v2.4 frame
+			raw: map[string]interface{}{
+				"UFID":   &tag.UFID{Provider: musicBrainzProvider, Identifier: []byte(id2)},
+				"TXXX":   &tag.Comm{Description: "MusicBrainz Album Id", Text: id1},
+				"TXXX_0": &tag.Comm{Description: "MusicBrainz Album Artist Id", Text: id1 + id2},
+			},
+			ids: MusicBrainzIDs{Release: id1, Recording: id2, AlbumArtists: []string{id1, id2}},
+		},
+		{ // ID3v2 from the Index
+			raw: map[string]interface{}{
+				"UFID": map[string]interface{}{"Provider": musicBrainzProvider, "Identifier": "YjEwYmJiZmMtY2Y5ZS00MmUwLWJlMTctZTJjM2UxZDI2MDBk"},
+			},
+			ids: MusicBrainzIDs{Recording: id2},
+		},
+		{ // MP4
+			raw: map[string]interface{}{"MusicBrainz Release Group Id": "8F3471B5-7E6A-48DA-86A9-C1C07A0F47AE", "MusicBrainz Release Track Id": id2},
+			ids: MusicBrainzIDs{ReleaseGroup: id1, Track: id2},
+		},
+		{
+			raw: map[string]interface{}{"musicbrainz_albumid": "nope"},
+		},
+	} {
+		if ids := musicBrainzFromRaw(tc.raw); !reflect.DeepEqual(ids, tc.ids) {
+			t.Fatalf("%d: %+v", idx, ids)
+		}
+	}
+}
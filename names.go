@@ -0,0 +1,337 @@
+package musefuse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The fields whose values are grouped by nameKey. AlbumArtist shares
+// nameArtist with Artist.
+const (
+	nameArtist = "artist"
+	nameAlbum  = "album"
+	nameGenre  = "genre"
+)
+
+// nameArticles are ignored at the start of a name, or after a comma at the
+// end of it, so "The Beatles" and "Beatles, The" are the same.
+var nameArticles = []string{"the", "a", "an"}
+
+// nameKey returns the key that different spellings of the same name share.
+// Case, runs of whitespace and leading articles are ignored. Names are
+// normalised to NFC, so composed and decomposed forms of the same accented
+// letter get the same key, then case folded, so "Straße" and "STRASSE" are
+// the same. Accents aren't ignored, as names that only differ by them may
+// well be different names; Aliases can ignore them for a field, see
+// accentlessKey.
+func nameKey(s string) string {
+	// The result of folding isn't always NFC, so it is normalised again:
+	s = norm.NFC.String(cases.Fold().String(norm.NFC.String(s)))
+	return nameKeyOf(s)
+}
+
+// accentlessKey is nameKey, but ignoring accents and other combining marks
+// too.
+func accentlessKey(s string) string {
+	strip := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	stripped, _, err := transform.String(strip, s)
+	if err != nil {
+		stripped = s
+	}
+	return nameKey(stripped)
+}
+
+// nameKeyOf collapses the whitespace in the folded name s, and removes any
+// leading article.
+func nameKeyOf(s string) string {
+	key := collapseSpace(s)
+	for _, article := range nameArticles {
+		rest := key
+		if strings.HasPrefix(key, article+" ") {
+			rest = key[len(article)+1:]
+		} else if strings.HasSuffix(key, ", "+article) {
+			rest = key[:len(key)-len(article)-2]
+		}
+		if rest != key && !isArticle(rest) {
+			return rest
+		}
+	}
+	return key
+}
+
+func isArticle(s string) bool {
+	for _, article := range nameArticles {
+		if s == article {
+			return true
+		}
+	}
+	return false
+}
+
+// collapseSpace trims s and replaces each run of whitespace with one space.
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Aliases maps alternative spellings of artists and genres to the one to
+// use. Spellings are matched by nameKey, so "beatles" catches "Beatles" too,
+// or by accentlessKey for the fields that ignore accents.
+type Aliases struct {
+	names   map[string]map[string]string // field -> key(alias) -> name
+	accents map[string]bool              // fields whose accents are ignored
+}
+
+// LoadAliases reads an alias file, which is JSON mapping the name to use to
+// its aliases, for artists and genres. "ignoreAccents" lists the fields
+// (artist, album or genre) whose names are grouped ignoring accents, so
+// "Björk" and "Bjork" are the same:
+//
+//	{
+//	  "artist": {"The Beatles": ["Fab Four"], "Prince": ["The Artist"]},
+//	  "genre": {"Hip-Hop": ["Hip Hop", "Rap"]},
+//	  "ignoreAccents": ["artist"]
+//	}
+func LoadAliases(file string) (*Aliases, error) {
+	bts, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAliases(file, bts)
+}
+
+// ParseAliases parses the alias file in bts; see LoadAliases. file is only
+// used to report errors.
+func ParseAliases(file string, bts []byte) (*Aliases, error) {
+	var raw map[string]json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(bts))
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("musefuse: aliases %s: %w", file, err)
+	}
+
+	aliases := &Aliases{names: map[string]map[string]string{}, accents: map[string]bool{}}
+	if msg, ok := raw["ignoreAccents"]; ok {
+		var fields []string
+		if err := json.Unmarshal(msg, &fields); err != nil {
+			return nil, fmt.Errorf("musefuse: aliases %s: ignoreAccents: %w", file, err)
+		}
+		for _, field := range fields {
+			if field != nameArtist && field != nameAlbum && field != nameGenre {
+				return nil, fmt.Errorf("musefuse: aliases %s: unknown ignoreAccents field %q, expected 'artist', 'album' or 'genre'", file, field)
+			}
+			aliases.accents[field] = true
+		}
+		delete(raw, "ignoreAccents")
+	}
+
+	for field, msg := range raw {
+		if field != nameArtist && field != nameGenre {
+			return nil, fmt.Errorf("musefuse: aliases %s: unknown field %q, expected 'artist', 'genre' or 'ignoreAccents'", file, field)
+		}
+		var names map[string][]string
+		if err := json.Unmarshal(msg, &names); err != nil {
+			return nil, fmt.Errorf("musefuse: aliases %s: %s: %w", file, field, err)
+		}
+		keys := map[string]string{}
+		for name, alts := range names {
+			name = collapseSpace(name)
+			if name == "" {
+				return nil, fmt.Errorf("musefuse: aliases %s: empty %s name", file, field)
+			}
+			for _, alt := range append([]string{name}, alts...) {
+				key := aliases.key(field, alt)
+				if cur, ok := keys[key]; ok && cur != name {
+					return nil, fmt.Errorf("musefuse: aliases %s: %s %q is an alias for both %q and %q", file, field, alt, cur, name)
+				}
+				keys[key] = name
+			}
+		}
+		aliases.names[field] = keys
+	}
+	return aliases, nil
+}
+
+// key returns the nameKey of value, or its accentlessKey if field ignores
+// accents.
+func (aliases *Aliases) key(field, value string) string {
+	if aliases != nil && aliases.accents[field] {
+		return accentlessKey(value)
+	}
+	return nameKey(value)
+}
+
+// name returns the name to use for value, if it is a known alias.
+func (aliases *Aliases) name(field, value string) (string, bool) {
+	if aliases == nil {
+		return "", false
+	}
+	name, ok := aliases.names[field][aliases.key(field, value)]
+	return name, ok
+}
+
+// nameGroup is every spelling of a name, and how many times each has been
+// seen. The most common one is shown.
+type nameGroup struct {
+	spellings map[string]int
+	entries   map[string]int
+	display   string
+
+	// alias is set if display comes from Aliases rather than spellings.
+	alias bool
+}
+
+type nameRef struct {
+	field, key, spelling string
+}
+
+// tagNames chooses which spelling to show for each group of names that only
+// differ by nameKey, or that are aliases of one another.
+type tagNames struct {
+	aliases *Aliases
+	groups  map[string]map[string]*nameGroup
+	byEntry map[string][]nameRef
+}
+
+func newTagNames() *tagNames {
+	return &tagNames{
+		groups:  map[string]map[string]*nameGroup{},
+		byEntry: map[string][]nameRef{},
+	}
+}
+
+// key returns the group key for value, following aliases.
+func (names *tagNames) key(field, value string) string {
+	if name, ok := names.aliases.name(field, value); ok {
+		return names.aliases.key(field, name)
+	}
+	return names.aliases.key(field, value)
+}
+
+// display returns the spelling to show for value.
+func (names *tagNames) display(field, value string) string {
+	if group := names.groups[field][names.key(field, value)]; group != nil {
+		return group.display
+	}
+	if name, ok := names.aliases.name(field, value); ok {
+		return name
+	}
+	return collapseSpace(value)
+}
+
+// entryNames returns the spellings of each name used by meta.
+func entryNames(meta *Metadata, delimiters []string) (refs []nameRef) {
+	add := func(field string, values ...string) {
+		for _, v := range values {
+			if v = collapseSpace(v); v != "" {
+				refs = append(refs, nameRef{field: field, spelling: v})
+			}
+		}
+	}
+	add(nameArtist, meta.Artist, meta.AlbumArtist)
+	add(nameArtist, meta.ArtistValues(delimiters)...)
+	add(nameAlbum, meta.Album)
+	add(nameGenre, meta.Genre)
+	add(nameGenre, meta.GenreValues(delimiters)...)
+	return refs
+}
+
+// add counts the names used by the entry at key. It returns the keys of the
+// other entries whose names are now shown differently.
+func (names *tagNames) add(key string, entry *FileEntry, delimiters []string) []string {
+	if entry.Err != "" || entry.Metadata == nil {
+		return nil
+	}
+
+	var changed []*nameGroup
+	refs := entryNames(entry.Metadata, delimiters)
+	for i := range refs {
+		ref := &refs[i]
+		ref.key = names.key(ref.field, ref.spelling)
+
+		groups := names.groups[ref.field]
+		if groups == nil {
+			groups = map[string]*nameGroup{}
+			names.groups[ref.field] = groups
+		}
+		group := groups[ref.key]
+		if group == nil {
+			group = &nameGroup{spellings: map[string]int{}, entries: map[string]int{}}
+			if name, ok := names.aliases.name(ref.field, ref.spelling); ok {
+				group.display, group.alias = name, true
+			}
+			groups[ref.key] = group
+		}
+		group.spellings[ref.spelling]++
+		group.entries[key]++
+		if group.update() {
+			changed = append(changed, group)
+		}
+	}
+	names.byEntry[key] = refs
+	return changedEntries(changed, key)
+}
+
+// remove forgets the names used by the entry at key. It returns the keys of
+// the other entries whose names are now shown differently.
+func (names *tagNames) remove(key string) []string {
+	var changed []*nameGroup
+	for _, ref := range names.byEntry[key] {
+		group := names.groups[ref.field][ref.key]
+		if group.spellings[ref.spelling]--; group.spellings[ref.spelling] == 0 {
+			delete(group.spellings, ref.spelling)
+		}
+		if group.entries[key]--; group.entries[key] == 0 {
+			delete(group.entries, key)
+		}
+		if len(group.entries) == 0 {
+			delete(names.groups[ref.field], ref.key)
+		} else if group.update() {
+			changed = append(changed, group)
+		}
+	}
+	delete(names.byEntry, key)
+	return changedEntries(changed, key)
+}
+
+// update chooses the most common spelling to show, preferring the one that
+// sorts first if there is a tie. It returns true if the choice changed.
+func (group *nameGroup) update() bool {
+	if group.alias {
+		return false
+	}
+	best, count := "", 0
+	for spelling, n := range group.spellings {
+		if n > count || (n == count && spelling < best) {
+			best, count = spelling, n
+		}
+	}
+	if best == group.display {
+		return false
+	}
+	group.display = best
+	return true
+}
+
+func changedEntries(groups []*nameGroup, except string) []string {
+	seen := map[string]bool{except: true}
+	var keys []string
+	for _, group := range groups {
+		for key := range group.entries {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,82 @@
+package musefuse
+
+import (
+	"testing"
+)
+
+func TestNameKey(t *testing.T) {
+	for idx, tc := range []struct {
+		a, b string
+	}{
+		{"The Beatles", "beatles"},
+		{"Beatles, The", "the  beatles"},
+		{"Beyonc\u00e9", "Beyonce\u0301"},
+		{"  Sigur   Rós ", "sigur rós"},
+		{"Straße", "STRASSE"},
+		{"\ufb01sh", "FISH"},
+		{"\u1100\u1161", "\uac00"},                                     // Hangul jamo and syllable
+		{"\u30ab\u3099\u30e9\u30aa\u30b1", "\u30ac\u30e9\u30aa\u30b1"}, // kana and dakuten
+		{"a\u0323\u0302", "a\u0302\u0323"},                             // marks out of canonical order
+		{"A Tribe Called Quest", "Tribe Called Quest"},
+	} {
+		if nameKey(tc.a) != nameKey(tc.b) {
+			t.Fatal(idx, nameKey(tc.a), nameKey(tc.b))
+		}
+	}
+	for idx, tc := range []struct {
+		a, b string
+	}{
+		{"The The", "The"},
+		{"A", "An"},
+		{"Björk", "Bjork Bjork"},
+		{"Röyksopp", "Royksopp"},
+	} {
+		if nameKey(tc.a) == nameKey(tc.b) {
+			t.Fatal(idx, nameKey(tc.a))
+		}
+	}
+}
+
+func TestParseAliases(t *testing.T) {
+	aliases, err := ParseAliases("a.json", []byte(`{"artist": {"The Beatles": ["Fab Four"]}, "genre": {"Hip-Hop": ["Rap"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := aliases.name(nameArtist, "the fab four"); !ok || name != "The Beatles" {
+		t.Fatal(name, ok)
+	}
+	if name, ok := aliases.name(nameGenre, "RAP"); !ok || name != "Hip-Hop" {
+		t.Fatal(name, ok)
+	}
+	if _, ok := aliases.name(nameGenre, "Fab Four"); ok {
+		t.Fatal("unexpected alias from another field")
+	}
+
+	for idx, src := range []string{
+		`{"album": {"X": ["Y"]}}`,
+		`{"artist": {"A": ["C"], "B": ["c"]}}`,
+		`{"artist": {"": ["C"]}}`,
+		`{"ignoreAccents": ["title"]}`,
+		`[]`,
+	} {
+		if _, err := ParseAliases("a.json", []byte(src)); err == nil {
+			t.Fatal(idx, "expected error")
+		}
+	}
+}
+
+func TestAliasesIgnoreAccents(t *testing.T) {
+	aliases, err := ParseAliases("a.json", []byte(`{"artist": {"Sigur Rós": ["Sigur Ros"]}, "ignoreAccents": ["artist"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliases.key(nameArtist, "Röyksopp") != aliases.key(nameArtist, "royksopp") {
+		t.Fatal("expected accents to be ignored")
+	}
+	if aliases.key(nameGenre, "Música") == aliases.key(nameGenre, "Musica") {
+		t.Fatal("expected accents to be kept for genre")
+	}
+	if name, ok := aliases.name(nameArtist, "SIGUR RÓS"); !ok || name != "Sigur Rós" {
+		t.Fatal(name, ok)
+	}
+}
@@ -2,9 +2,12 @@ package musefuse
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 
 	"bazil.org/fuse"
@@ -23,6 +26,19 @@ type fileNode struct {
 	name      string
 	parent    *dirNode
 	entry     *FileEntry
+
+	// symlink presents the file as a symlink to the source file rather than
+	// a copy of it. It is set before the file is added to a dirNode.
+	symlink bool
+
+	// view and base are the name of the view the file was added for, and its
+	// name before any " vN" suffix and extension was added; see FS.addNode.
+	view string
+	base string
+
+	// match is how a file in ViewPlaylists was matched to the playlist's
+	// track. It is set before the file is added to a dirNode.
+	match *PlaylistMatch
 }
 
 func newFileNode(hmap *handleMap, inode uint64, name string, entry *FileEntry) *fileNode {
@@ -36,12 +52,33 @@ func newFileNode(hmap *handleMap, inode uint64, name string, entry *FileEntry) *
 
 func (file *fileNode) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Inode = file.inode
-	a.Mode = 0600
-	a.Size = uint64(file.entry.File.Size)
 	a.Mtime = file.entry.File.ModTime
+	if file.symlink {
+		a.Mode = os.ModeSymlink | 0777
+		a.Size = uint64(len(file.target()))
+	} else {
+		a.Mode = 0600
+		a.Size = uint64(file.entry.File.Size)
+	}
 	return nil
 }
 
+// target returns the absolute path to the source file.
+func (file *fileNode) target() string {
+	path := file.entry.File.FullPath()
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path
+}
+
+func (file *fileNode) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	if !file.symlink {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return file.target(), nil
+}
+
 func (file *fileNode) ReadAll(ctx context.Context) ([]byte, error) {
 	path := filepath.Join(file.entry.File.Prefix, file.entry.File.Path)
 	return ioutil.ReadFile(path)
@@ -60,14 +97,54 @@ func (file *fileNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fus
 	return handle, nil
 }
 
+// textNode is a small file generated by musefuse.
+type textNode struct {
+	inode uint64
+	name  string
+	data  []byte
+}
+
+func (text *textNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = text.inode
+	a.Mode = 0400
+	a.Size = uint64(len(text.data))
+	return nil
+}
+
+func (text *textNode) ReadAll(ctx context.Context) ([]byte, error) {
+	return text.data, nil
+}
+
+// dirNode is safe for concurrent use. Its mutable fields are only written
+// while holding both FS.lock and dirNode.lock, so code that holds FS.lock
+// (i.e. the FS mutators) may read them without taking dirNode.lock; all other
+// readers, such as FUSE requests and the web server, must hold lock.RLock().
 type dirNode struct {
-	inode   uint64
-	name    string
-	parent  *dirNode
-	files   []*fileNode
-	dirs    []*dirNode
-	entries []fuse.Dirent
-	index   map[string]fs.Node
+	inode uint64
+	name  string
+
+	lock   sync.RWMutex
+	parent *dirNode
+	files  []*fileNode
+	dirs   []*dirNode
+	covers []*coverNode
+
+	// sidecars contains the FileSidecars shown alongside files. It is only
+	// used if showSidecars is set. showSidecars and showCovers are set for
+	// directories in a View with Sidecars or Cover set, and are only used by
+	// the FS mutators.
+	sidecars     []*fileNode
+	showSidecars bool
+	showCovers   bool
+	entries      []fuse.Dirent
+	index        map[string]fs.Node
+
+	// source is the directory this one mirrors in ViewSource, if any.
+	source string
+
+	// dynamic, if set, is called by Lookup for names that aren't in index.
+	// It is set before the dirNode is added to the tree and never changed.
+	dynamic func(name string) (fs.Node, error)
 }
 
 func newDirNode(inode uint64, name string) *dirNode {
@@ -79,6 +156,9 @@ func newDirNode(inode uint64, name string) *dirNode {
 }
 
 func (dir *dirNode) addDir(add *dirNode) {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+
 	dir.entries = append(dir.entries, fuse.Dirent{
 		Inode: add.inode,
 		Name:  add.name,
@@ -86,33 +166,214 @@ func (dir *dirNode) addDir(add *dirNode) {
 	})
 	dir.index[add.name] = add
 	dir.dirs = append(dir.dirs, add)
+
+	add.lock.Lock()
 	add.parent = dir
+	add.lock.Unlock()
 }
 
 func (dir *dirNode) addFile(file *fileNode) {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+
+	dir.addFileEntry(file)
+	dir.files = append(dir.files, file)
+}
+
+func (dir *dirNode) addSidecar(file *fileNode) {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+
+	dir.addFileEntry(file)
+	dir.sidecars = append(dir.sidecars, file)
+}
+
+// addFileEntry must be called with dir.lock held.
+func (dir *dirNode) addFileEntry(file *fileNode) {
+	typ := fuse.DT_File
+	if file.symlink {
+		typ = fuse.DT_Link
+	}
 	dir.entries = append(dir.entries, fuse.Dirent{
 		Inode: file.inode,
 		Name:  file.name,
-		Type:  fuse.DT_File,
+		Type:  typ,
 	})
 	dir.index[file.name] = file
-	dir.files = append(dir.files, file)
 	file.parent = dir
 }
 
+func (dir *dirNode) removeDir(rem *dirNode) {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+
+	dir.removeEntry(rem.name)
+	for i, d := range dir.dirs {
+		if d == rem {
+			dir.dirs = append(dir.dirs[:i], dir.dirs[i+1:]...)
+			break
+		}
+	}
+
+	rem.lock.Lock()
+	rem.parent = nil
+	rem.lock.Unlock()
+}
+
+func (dir *dirNode) removeFile(rem *fileNode) {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+
+	dir.removeEntry(rem.name)
+	for i, f := range dir.files {
+		if f == rem {
+			dir.files = append(dir.files[:i], dir.files[i+1:]...)
+			break
+		}
+	}
+	rem.parent = nil
+}
+
+func (dir *dirNode) addCover(cover *coverNode) {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+
+	dir.entries = append(dir.entries, fuse.Dirent{
+		Inode: cover.inode,
+		Name:  cover.name,
+		Type:  fuse.DT_File,
+	})
+	dir.index[cover.name] = cover
+	dir.covers = append(dir.covers, cover)
+}
+
+func (dir *dirNode) removeCovers() {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+
+	for _, cover := range dir.covers {
+		dir.removeEntry(cover.name)
+	}
+	dir.covers = nil
+}
+
+func (dir *dirNode) removeSidecars() {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+
+	for _, file := range dir.sidecars {
+		dir.removeEntry(file.name)
+		file.parent = nil
+	}
+	dir.sidecars = nil
+}
+
+func (dir *dirNode) addText(text *textNode) {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+
+	dir.entries = append(dir.entries, fuse.Dirent{
+		Inode: text.inode,
+		Name:  text.name,
+		Type:  fuse.DT_File,
+	})
+	dir.index[text.name] = text
+}
+
+func (dir *dirNode) removeText(text *textNode) {
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+
+	dir.removeEntry(text.name)
+}
+
+// removeEntry must be called with dir.lock held. entries is never modified in
+// place as it may have been returned by ReadDirAll.
+func (dir *dirNode) removeEntry(name string) {
+	delete(dir.index, name)
+	for i, ent := range dir.entries {
+		if ent.Name == name {
+			entries := make([]fuse.Dirent, 0, len(dir.entries)-1)
+			entries = append(entries, dir.entries[:i]...)
+			entries = append(entries, dir.entries[i+1:]...)
+			dir.entries = entries
+			break
+		}
+	}
+}
+
+// setSource sets dir.source, unless it is already set. If a database has more
+// than one path and FS.SetDatabasePaths wasn't told, the first one wins.
+func (dir *dirNode) setSource(source string) {
+	dir.lock.Lock()
+	if dir.source == "" {
+		dir.source = source
+	}
+	dir.lock.Unlock()
+}
+
+// uniqueName returns base+ext, or "base vN"+ext if that name is taken. It must
+// be called with FS.lock held.
+func (dir *dirNode) uniqueName(base, ext string) string {
+	name := base + ext
+	for ver := 2; ; ver++ {
+		if _, ok := dir.index[name]; !ok {
+			return name
+		}
+		name = fmt.Sprintf("%s v%d%s", base, ver, ext)
+	}
+}
+
+// childPath returns the slash-separated path, relative to the root, of the
+// child called name. It must be called with FS.lock held.
+func (dir *dirNode) childPath(name string) string {
+	parts := []string{name}
+	for node := dir; node != nil && node.name != ""; node = node.parent {
+		parts = append(parts, node.name)
+	}
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return strings.Join(parts, "/")
+}
+
+func (dir *dirNode) child(name string) (fs.Node, bool) {
+	dir.lock.RLock()
+	node, ok := dir.index[name]
+	dir.lock.RUnlock()
+	return node, ok
+}
+
+// dirents returns the directory's entries. The returned slice must not be
+// modified.
+func (dir *dirNode) dirents() []fuse.Dirent {
+	dir.lock.RLock()
+	entries := dir.entries
+	dir.lock.RUnlock()
+	return entries
+}
+
 func (dir *dirNode) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Inode = dir.inode
 	a.Mode = os.ModeDir | 0700
 	return nil
 }
 
-func (dir *dirNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	if node, ok := dir.index[name]; ok {
+// lookupChild returns the child called name, or asks dir.dynamic for it.
+func (dir *dirNode) lookupChild(name string) (fs.Node, error) {
+	if node, ok := dir.child(name); ok {
 		return node, nil
 	}
+	if dir.dynamic != nil {
+		return dir.dynamic(name)
+	}
 	return nil, fuse.ENOENT
 }
 
+func (dir *dirNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	return dir.lookupChild(name)
+}
+
 func (dir *dirNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	return dir.entries, nil
+	return dir.dirents(), nil
 }
@@ -0,0 +1,143 @@
+// Package m3u reads M3U and M3U8 playlists, both plain lists of locations and
+// the extended form starting with "#EXTM3U".
+package m3u
+
+import (
+	"bufio"
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type Playlist struct {
+	// Title is from the "#PLAYLIST:" directive, if any.
+	Title string
+
+	Tracks []Track
+}
+
+type Track struct {
+	// Location is the path or URL of the track, exactly as it appears in the
+	// playlist. Paths may be relative to the playlist.
+	Location string
+
+	// Title, Artist and Duration are from the "#EXTINF:" directive before the
+	// track, which looks like "#EXTINF:123,Artist - Title". Duration is zero
+	// if unknown.
+	Title    string
+	Artist   string
+	Duration time.Duration
+
+	// Album is from the last "#EXTALB:" directive, and Artist from the last
+	// "#EXTART:" if "#EXTINF:" doesn't give one.
+	Album string
+}
+
+// File returns the path to the track's file, with any '\' replaced with '/',
+// or an empty string if it isn't a local file. The path is relative if
+// Location is.
+func (t Track) File() string {
+	loc := t.Location
+	if !strings.Contains(loc, "://") {
+		return strings.ReplaceAll(loc, `\`, "/")
+	}
+
+	u, err := url.Parse(loc)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme != "file" {
+		return ""
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return ""
+	}
+	return u.Path
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// Unmarshal parses an M3U playlist. The playlist is UTF-8 if it is valid
+// UTF-8, which it should be for ".m3u8", otherwise it is assumed to be
+// Latin-1, which is what most players write to ".m3u".
+func Unmarshal(bts []byte) (*Playlist, error) {
+	bts = bytes.TrimPrefix(bts, utf8BOM)
+	text := string(bts)
+	if !utf8.Valid(bts) {
+		text = decodeLatin1(bts)
+	}
+
+	var pls Playlist
+	var next Track
+	var album, artist string
+
+	scn := bufio.NewScanner(strings.NewReader(text))
+	scn.Buffer(nil, 1<<20)
+	for scn.Scan() {
+		line := strings.TrimSpace(scn.Text())
+		switch {
+		case line == "":
+			continue
+
+		case strings.HasPrefix(line, "#EXTINF:"):
+			next.Duration, next.Artist, next.Title = parseExtInf(line[len("#EXTINF:"):])
+
+		case strings.HasPrefix(line, "#EXTALB:"):
+			album = strings.TrimSpace(line[len("#EXTALB:"):])
+
+		case strings.HasPrefix(line, "#EXTART:"):
+			artist = strings.TrimSpace(line[len("#EXTART:"):])
+
+		case strings.HasPrefix(line, "#PLAYLIST:"):
+			pls.Title = strings.TrimSpace(line[len("#PLAYLIST:"):])
+
+		case strings.HasPrefix(line, "#"):
+			continue // "#EXTM3U", other directives and comments
+
+		default:
+			next.Location = line
+			next.Album = album
+			if next.Artist == "" {
+				next.Artist = artist
+			}
+			pls.Tracks = append(pls.Tracks, next)
+			next = Track{}
+		}
+	}
+	if err := scn.Err(); err != nil {
+		return nil, err
+	}
+	return &pls, nil
+}
+
+// parseExtInf parses the part of an "#EXTINF:" directive after the colon,
+// like "123,Artist - Title". Some players add attributes after the duration,
+// like `-1 tvg-id="x",Title`, which are ignored.
+func parseExtInf(s string) (duration time.Duration, artist, title string) {
+	info := s
+	display := ""
+	if comma := strings.IndexByte(s, ','); comma >= 0 {
+		info, display = s[:comma], strings.TrimSpace(s[comma+1:])
+	}
+	if fields := strings.Fields(info); len(fields) > 0 {
+		if secs, err := strconv.ParseFloat(fields[0], 64); err == nil && secs > 0 {
+			duration = time.Duration(secs * float64(time.Second))
+		}
+	}
+
+	if dash := strings.Index(display, " - "); dash >= 0 {
+		return duration, strings.TrimSpace(display[:dash]), strings.TrimSpace(display[dash+3:])
+	}
+	return duration, "", display
+}
+
+func decodeLatin1(bts []byte) string {
+	runes := make([]rune, len(bts))
+	for i, b := range bts {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
@@ -0,0 +1,75 @@
+package m3u
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnmarshal(t *testing.T) {
+	bts := []byte("\xef\xbb\xbf#EXTM3U\r\n" +
+		"#PLAYLIST:Mix\r\n" +
+		"#EXTALB:Kind of Blue\r\n" +
+		"#EXTART:Miles Davis\r\n" +
+		"#EXTINF:545,Miles Davis - So What\r\n" +
+		"01 So What.flac\r\n" +
+		"\r\n" +
+		"#EXTINF:-1 tvg-id=\"x\",Freddie Freeloader\r\n" +
+		"file:///music/Miles%20Davis/02%20Freddie%20Freeloader.flac\r\n" +
+		"# A comment\r\n" +
+		"http://example.com/stream.mp3\r\n")
+
+	pls, err := Unmarshal(bts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pls.Title != "Mix" {
+		t.Fatal(pls.Title)
+	}
+	expected := []Track{
+		{Location: "01 So What.flac", Title: "So What", Artist: "Miles Davis", Album: "Kind of Blue", Duration: 545 * time.Second},
+		{Location: "file:///music/Miles%20Davis/02%20Freddie%20Freeloader.flac", Title: "Freddie Freeloader", Artist: "Miles Davis", Album: "Kind of Blue"},
+		{Location: "http://example.com/stream.mp3", Artist: "Miles Davis", Album: "Kind of Blue"},
+	}
+	if !reflect.DeepEqual(pls.Tracks, expected) {
+		t.Fatalf("%+v", pls.Tracks)
+	}
+
+	var files []string
+	for _, track := range pls.Tracks {
+		files = append(files, track.File())
+	}
+	if !reflect.DeepEqual(files, []string{"01 So What.flac", "/music/Miles Davis/02 Freddie Freeloader.flac", ""}) {
+		t.Fatalf("%q", files)
+	}
+}
+
+func TestTrackFileBackslashes(t *testing.T) {
+	for idx, tc := range []struct{ loc, file string }{
+		{`..\Music\a.mp3`, "../Music/a.mp3"},
+		{`C:\Music\a.mp3`, "C:/Music/a.mp3"},
+		{"file:///music/a.mp3", "/music/a.mp3"},
+	} {
+		if file := (Track{Location: tc.loc}).File(); file != tc.file {
+			t.Fatal(idx, file)
+		}
+	}
+}
+
+func TestUnmarshalLatin1(t *testing.T) {
+	pls, err := Unmarshal([]byte("#EXTINF:10,Beyonc\xe9 - Halo\nBeyonc\xe9/Halo.mp3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pls.Tracks) != 1 || pls.Tracks[0].Artist != "Beyoncé" || pls.Tracks[0].Location != "Beyoncé/Halo.mp3" {
+		t.Fatalf("%+v", pls.Tracks)
+	}
+
+	pls, err = Unmarshal([]byte("Beyoncé/Halo.mp3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pls.Tracks) != 1 || pls.Tracks[0].Location != "Beyoncé/Halo.mp3" {
+		t.Fatalf("%+v", pls.Tracks)
+	}
+}
@@ -5,7 +5,11 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/shabbyrobe/musefuse/playlist/m3u"
+	"github.com/shabbyrobe/musefuse/playlist/pls"
+	"github.com/shabbyrobe/musefuse/playlist/wpl"
 	"github.com/shabbyrobe/musefuse/playlist/xspf"
 )
 
@@ -18,6 +22,47 @@ type Track interface {
 	File() string
 }
 
+// TrackInfo is what a playlist says about a track besides its file, which is
+// used to find the track when the file has moved. Fields are empty if the
+// playlist doesn't say.
+type TrackInfo struct {
+	// Identifier is a URI for the track, such as a MusicBrainz recording URL.
+	Identifier string
+
+	Title    string
+	Artist   string
+	Album    string
+	TrackNum int
+	Duration time.Duration
+}
+
+// Describe returns what is known about t besides its file.
+func Describe(t Track) TrackInfo {
+	switch t := t.(type) {
+	case xspf.Track:
+		return TrackInfo{
+			Identifier: t.Identifier,
+			Title:      t.Title,
+			Artist:     t.Creator,
+			Album:      t.Album,
+			TrackNum:   t.TrackNum,
+			Duration:   time.Duration(t.Duration),
+		}
+
+	case m3u.Track:
+		return TrackInfo{Title: t.Title, Artist: t.Artist, Album: t.Album, Duration: t.Duration}
+
+	case pls.Track:
+		// Titles are usually "Artist - Title", as in M3U:
+		info := TrackInfo{Title: t.Title, Duration: t.Duration}
+		if dash := strings.Index(t.Title, " - "); dash >= 0 {
+			info.Artist, info.Title = strings.TrimSpace(t.Title[:dash]), strings.TrimSpace(t.Title[dash+3:])
+		}
+		return info
+	}
+	return TrackInfo{}
+}
+
 func LoadPlaylistFile(file string) (Playlist, error) {
 	switch strings.ToLower(filepath.Ext(file)) {
 	case ".xspf":
@@ -33,6 +78,45 @@ func LoadPlaylistFile(file string) (Playlist, error) {
 
 		return &xspfPlaylist{xspf: pls}, nil
 
+	case ".m3u", ".m3u8":
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		pls, err := m3u.Unmarshal(bts)
+		if err != nil {
+			return nil, err
+		}
+
+		return &m3uPlaylist{m3u: pls}, nil
+
+	case ".pls":
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := pls.Unmarshal(bts)
+		if err != nil {
+			return nil, err
+		}
+
+		return &plsPlaylist{pls: p}, nil
+
+	case ".wpl":
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		pls, err := wpl.Unmarshal(bts)
+		if err != nil {
+			return nil, err
+		}
+
+		return &wplPlaylist{wpl: pls}, nil
+
 	default:
 		return nil, fmt.Errorf("playlist: unsupported file %q", file)
 	}
@@ -62,3 +146,72 @@ func (x *xspfPlaylist) Tracks() []Track {
 	}
 	return out
 }
+
+type m3uPlaylist struct {
+	m3u *m3u.Playlist
+}
+
+func (m *m3uPlaylist) Files() []string {
+	out := make([]string, 0, len(m.m3u.Tracks))
+	for _, v := range m.m3u.Tracks {
+		f := v.File()
+		if f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func (m *m3uPlaylist) Tracks() []Track {
+	out := make([]Track, len(m.m3u.Tracks))
+	for i, v := range m.m3u.Tracks {
+		out[i] = v
+	}
+	return out
+}
+
+type plsPlaylist struct {
+	pls *pls.Playlist
+}
+
+func (p *plsPlaylist) Files() []string {
+	out := make([]string, 0, len(p.pls.Tracks))
+	for _, v := range p.pls.Tracks {
+		f := v.File()
+		if f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func (p *plsPlaylist) Tracks() []Track {
+	out := make([]Track, len(p.pls.Tracks))
+	for i, v := range p.pls.Tracks {
+		out[i] = v
+	}
+	return out
+}
+
+type wplPlaylist struct {
+	wpl *wpl.Playlist
+}
+
+func (p *wplPlaylist) Files() []string {
+	out := make([]string, 0, len(p.wpl.Tracks))
+	for _, v := range p.wpl.Tracks {
+		f := v.File()
+		if f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func (p *wplPlaylist) Tracks() []Track {
+	out := make([]Track, len(p.wpl.Tracks))
+	for i, v := range p.wpl.Tracks {
+		out[i] = v
+	}
+	return out
+}
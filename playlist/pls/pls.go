@@ -0,0 +1,133 @@
+// Package pls reads Winamp PLS playlists.
+package pls
+
+import (
+	"bufio"
+	"bytes"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type Playlist struct {
+	Tracks []Track
+}
+
+type Track struct {
+	// Location is the path or URL of the track, exactly as it appears in the
+	// playlist. Paths may be relative to the playlist, and often use '\'.
+	Location string
+
+	Title string
+
+	// Duration is zero if unknown, which PLS writes as -1.
+	Duration time.Duration
+}
+
+// File returns the path to the track's file, with any '\' replaced with '/',
+// or an empty string if it isn't a local file. The path is relative if
+// Location is.
+func (t Track) File() string {
+	loc := t.Location
+	if !strings.Contains(loc, "://") {
+		return strings.ReplaceAll(loc, `\`, "/")
+	}
+
+	u, err := url.Parse(loc)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme != "file" {
+		return ""
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return ""
+	}
+	return u.Path
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// Unmarshal parses a PLS playlist. Tracks are ordered by their number, so
+// the "NumberOfEntries" key, which is often wrong or missing, is ignored, as
+// are gaps in the numbering. The playlist is assumed to be Latin-1 if it
+// isn't valid UTF-8.
+func Unmarshal(bts []byte) (*Playlist, error) {
+	bts = bytes.TrimPrefix(bts, utf8BOM)
+	text := string(bts)
+	if !utf8.Valid(bts) {
+		text = decodeLatin1(bts)
+	}
+
+	tracks := map[int]*Track{}
+	track := func(n int) *Track {
+		t := tracks[n]
+		if t == nil {
+			t = &Track{}
+			tracks[n] = t
+		}
+		return t
+	}
+
+	scn := bufio.NewScanner(strings.NewReader(text))
+	scn.Buffer(nil, 1<<20)
+	for scn.Scan() {
+		line := strings.TrimSpace(scn.Text())
+		eq := strings.IndexByte(line, '=')
+		if line == "" || line[0] == ';' || line[0] == '[' || eq < 0 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(line[:eq])), strings.TrimSpace(line[eq+1:])
+
+		var field string
+		for _, f := range []string{"file", "title", "length"} {
+			if strings.HasPrefix(key, f) {
+				field = f
+				break
+			}
+		}
+		n, err := strconv.Atoi(key[len(field):])
+		if field == "" || err != nil {
+			continue // "NumberOfEntries", "Version" and the like
+		}
+
+		switch field {
+		case "file":
+			track(n).Location = value
+		case "title":
+			track(n).Title = value
+		case "length":
+			if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+				track(n).Duration = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	if err := scn.Err(); err != nil {
+		return nil, err
+	}
+
+	nums := make([]int, 0, len(tracks))
+	for n, t := range tracks {
+		if t.Location != "" {
+			nums = append(nums, n)
+		}
+	}
+	sort.Ints(nums)
+
+	var pls Playlist
+	for _, n := range nums {
+		pls.Tracks = append(pls.Tracks, *tracks[n])
+	}
+	return &pls, nil
+}
+
+func decodeLatin1(bts []byte) string {
+	runes := make([]rune, len(bts))
+	for i, b := range bts {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
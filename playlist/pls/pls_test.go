@@ -0,0 +1,42 @@
+package pls
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnmarshal(t *testing.T) {
+	// No NumberOfEntries, CRLF, Windows paths and the entries out of order:
+	bts := []byte("[playlist]\r\n" +
+		"File2=..\\Music\\Miles Davis\\02 Freddie Freeloader.mp3\r\n" +
+		"Title2=Miles Davis - Freddie Freeloader\r\n" +
+		"Length2=-1\r\n" +
+		"file1=C:\\Music\\Miles Davis\\01 So What.mp3\r\n" +
+		"Title1=Miles Davis - So What\r\n" +
+		"Length1=545\r\n" +
+		"Title3=No file\r\n" +
+		"File10=http://example.com/stream\r\n" +
+		"Version=2\r\n")
+
+	pls, err := Unmarshal(bts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Track{
+		{Location: `C:\Music\Miles Davis\01 So What.mp3`, Title: "Miles Davis - So What", Duration: 545 * time.Second},
+		{Location: `..\Music\Miles Davis\02 Freddie Freeloader.mp3`, Title: "Miles Davis - Freddie Freeloader"},
+		{Location: "http://example.com/stream"},
+	}
+	if !reflect.DeepEqual(pls.Tracks, expected) {
+		t.Fatalf("%+v", pls.Tracks)
+	}
+
+	var files []string
+	for _, track := range pls.Tracks {
+		files = append(files, track.File())
+	}
+	if !reflect.DeepEqual(files, []string{"C:/Music/Miles Davis/01 So What.mp3", "../Music/Miles Davis/02 Freddie Freeloader.mp3", ""}) {
+		t.Fatalf("%q", files)
+	}
+}
@@ -0,0 +1,87 @@
+// Package wpl reads Windows Media Player playlists, which are SMIL documents.
+package wpl
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+type Playlist struct {
+	Title  string  `xml:"head>title"`
+	Meta   []Meta  `xml:"head>meta"`
+	Tracks []Track `xml:"body>seq>media"`
+}
+
+type Meta struct {
+	Name    string `xml:"name,attr"`
+	Content string `xml:"content,attr"`
+}
+
+type Track struct {
+	// Location is the path or URL of the track, exactly as it appears in the
+	// playlist. Paths may be relative to the playlist, and usually use '\'.
+	Location string `xml:"src,attr"`
+
+	// TrackID and ContentID are GUIDs used by Windows Media Player.
+	TrackID   string `xml:"tid,attr"`
+	ContentID string `xml:"cid,attr"`
+}
+
+// File returns the path to the track's file, with any '\' replaced with '/',
+// or an empty string if it isn't a local file. The path is relative if
+// Location is.
+func (t Track) File() string {
+	loc := t.Location
+	if !strings.Contains(loc, "://") {
+		return strings.ReplaceAll(loc, `\`, "/")
+	}
+
+	u, err := url.Parse(loc)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme != "file" {
+		return ""
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return ""
+	}
+	return u.Path
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+func Unmarshal(bts []byte) (*Playlist, error) {
+	var pls Playlist
+
+	dec := xml.NewDecoder(bytes.NewReader(bytes.TrimPrefix(bts, utf8BOM)))
+	dec.CharsetReader = charsetReader
+	if err := dec.Decode(&pls); err != nil {
+		return nil, err
+	}
+	return &pls, nil
+}
+
+// charsetReader decodes the only other encodings seen in the wild, which are
+// treated as Latin-1 (windows-1252 only differs in characters that don't
+// turn up in file names).
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+		bts, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		runes := make([]rune, len(bts))
+		for i, b := range bts {
+			runes[i] = rune(b)
+		}
+		return strings.NewReader(string(runes)), nil
+	}
+	return nil, fmt.Errorf("wpl: unsupported charset %q", charset)
+}
@@ -0,0 +1,55 @@
+package wpl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshal(t *testing.T) {
+	bts := []byte("\xef\xbb\xbf<?wpl version=\"1.0\"?>\r\n" +
+		"<smil>\r\n" +
+		"    <head>\r\n" +
+		"        <meta name=\"Generator\" content=\"Microsoft Windows Media Player -- 12.0.7601.17514\"/>\r\n" +
+		"        <meta name=\"ItemCount\" content=\"2\"/>\r\n" +
+		"        <title>Miles &amp; Trane</title>\r\n" +
+		"    </head>\r\n" +
+		"    <body>\r\n" +
+		"        <seq>\r\n" +
+		"            <media src=\"..\\Music\\Miles Davis\\01 So What.wma\" tid=\"{A1}\" cid=\"{B1}\"/>\r\n" +
+		"            <media src=\"D:\\Music\\John Coltrane\\Giant Steps.mp3\"/>\r\n" +
+		"        </seq>\r\n" +
+		"    </body>\r\n" +
+		"</smil>\r\n")
+
+	pls, err := Unmarshal(bts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pls.Title != "Miles & Trane" || len(pls.Meta) != 2 {
+		t.Fatalf("%+v", pls)
+	}
+
+	var files []string
+	for _, track := range pls.Tracks {
+		files = append(files, track.File())
+	}
+	if !reflect.DeepEqual(files, []string{"../Music/Miles Davis/01 So What.wma", "D:/Music/John Coltrane/Giant Steps.mp3"}) {
+		t.Fatalf("%q", files)
+	}
+	if pls.Tracks[0].TrackID != "{A1}" {
+		t.Fatalf("%+v", pls.Tracks[0])
+	}
+}
+
+func TestUnmarshalLatin1(t *testing.T) {
+	bts := []byte("<?xml version=\"1.0\" encoding=\"windows-1252\"?>\n" +
+		"<smil><body><seq><media src=\"Beyonc\xe9\\Halo.mp3\"/></seq></body></smil>\n")
+
+	pls, err := Unmarshal(bts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pls.Tracks) != 1 || pls.Tracks[0].File() != "Beyoncé/Halo.mp3" {
+		t.Fatalf("%+v", pls.Tracks)
+	}
+}
@@ -0,0 +1,350 @@
+package musefuse
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/shabbyrobe/musefuse/playlist"
+)
+
+// UnresolvedSuffix is added to a playlist's name for the file in
+// ViewPlaylists listing the tracks that couldn't be found.
+const UnresolvedSuffix = ".unresolved.txt"
+
+// loadedPlaylist is a FilePlaylist, and where its tracks were placed in
+// ViewPlaylists.
+type loadedPlaylist struct {
+	file   FileInfo
+	base   string
+	tracks []playlistTrack
+
+	// name is the playlist's directory in ViewPlaylists, and nodes contains
+	// the node placed there for each track, or nil if the track couldn't be
+	// resolved. name is empty if the playlist isn't placed.
+	name  string
+	nodes []*fileNode
+
+	unresolved    *textNode
+	unresolvedDir *dirNode
+}
+
+// AddPlaylist adds, or replaces, a FilePlaylist, loading it from the file. If
+// it can't be loaded, it still appears in ViewSource.
+func (fs *FS) AddPlaylist(file FileInfo) error {
+	pls, loadErr := playlist.LoadPlaylistFile(file.FullPath())
+
+	fs.lock.Lock()
+	fs.removePlaylist(file.FullPath())
+	err := fs.replaceSourceFile(file)
+	if err == nil && loadErr == nil {
+		err = fs.addPlaylist(file, pls)
+	}
+	fs.clearQueries()
+	pending := fs.takePending()
+	fs.lock.Unlock()
+
+	fs.invalidate(pending)
+	if err == nil && loadErr != nil {
+		err = fmt.Errorf("musefuse: playlist %s: %w", file.FullPath(), loadErr)
+	}
+	return err
+}
+
+// RemovePlaylist removes the FilePlaylist at the full path key. It returns
+// false if there was no such playlist.
+func (fs *FS) RemovePlaylist(key string) bool {
+	fs.lock.Lock()
+	nodes, ok := fs.nodes[key]
+	delete(fs.nodes, key)
+	fs.removeNodes(nodes)
+	fs.removePlaylist(key)
+	pending := fs.takePending()
+	fs.lock.Unlock()
+
+	fs.invalidate(pending)
+	return ok
+}
+
+// addPlaylist must be called with fs.lock held.
+func (fs *FS) addPlaylist(file FileInfo, pls playlist.Playlist) error {
+	key := file.FullPath()
+	loaded := &loadedPlaylist{file: file, base: trimExt(filepath.Base(file.Path), "")}
+	for _, track := range pls.Tracks() {
+		loaded.tracks = append(loaded.tracks, newPlaylistTrack(track.File(), playlist.Describe(track)))
+	}
+	fs.playlists[key] = loaded
+
+	for _, ref := range playlistRefs(loaded) {
+		if fs.playlistRefs[ref] == nil {
+			fs.playlistRefs[ref] = map[string]bool{}
+		}
+		fs.playlistRefs[ref][key] = true
+	}
+
+	names := append(fs.playlistNames[loaded.base], key)
+	sort.Strings(names)
+	fs.playlistNames[loaded.base] = names
+	return fs.placePlaylistNames(loaded.base)
+}
+
+// removePlaylist must be called with fs.lock held.
+func (fs *FS) removePlaylist(key string) {
+	loaded := fs.playlists[key]
+	if loaded == nil {
+		return
+	}
+	fs.unplacePlaylist(loaded)
+	delete(fs.playlists, key)
+
+	for _, ref := range playlistRefs(loaded) {
+		delete(fs.playlistRefs[ref], key)
+		if len(fs.playlistRefs[ref]) == 0 {
+			delete(fs.playlistRefs, ref)
+		}
+	}
+
+	names := fs.playlistNames[loaded.base]
+	for i := range names {
+		if names[i] == key {
+			names = append(names[:i], names[i+1:]...)
+			break
+		}
+	}
+	if len(names) == 0 {
+		delete(fs.playlistNames, loaded.base)
+		return
+	}
+	fs.playlistNames[loaded.base] = names
+
+	// The rest were placed before, so they can be placed again:
+	_ = fs.placePlaylistNames(loaded.base)
+}
+
+// playlistRefs returns the refs of every track in a playlist, which are used
+// to find the playlists that need resolving again when audio is added or
+// removed; see entryRefs.
+func playlistRefs(loaded *loadedPlaylist) []string {
+	var refs []string
+	for _, track := range loaded.tracks {
+		refs = append(refs, track.refs...)
+	}
+	return refs
+}
+
+// placePlaylistNames places every playlist with the same base name again, as
+// whether they share the name changes their paths. It must be called with
+// fs.lock held.
+func (fs *FS) placePlaylistNames(base string) error {
+	for _, key := range fs.playlistNames[base] {
+		if err := fs.placePlaylist(fs.playlists[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replacePlaylistsFor resolves and places again the playlist tracks that may
+// refer to entry, as it has been added, removed or renamed. Only the tracks
+// that share one of its refs can have matched it before or match it now, so
+// the rest are left where they are. It must be called with fs.lock held.
+func (fs *FS) replacePlaylistsFor(entry *FileEntry) error {
+	refs := map[string]bool{}
+	seen := map[string]bool{}
+	var keys []string
+	for _, ref := range entryRefs(entry) {
+		refs[ref] = true
+		for pls := range fs.playlistRefs[ref] {
+			if !seen[pls] {
+				seen[pls] = true
+				keys = append(keys, pls)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	for _, pls := range keys {
+		loaded := fs.playlists[pls]
+		if loaded.name == "" {
+			continue
+		}
+		changed := false
+		for i, track := range loaded.tracks {
+			for _, ref := range track.refs {
+				if refs[ref] {
+					if err := fs.placePlaylistTrack(loaded, i); err != nil {
+						return err
+					}
+					changed = true
+					break
+				}
+			}
+		}
+		if changed {
+			if err := fs.placeUnresolved(loaded); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *FS) unplacePlaylist(loaded *loadedPlaylist) {
+	fs.unplaceUnresolved(loaded)
+	for i := range loaded.nodes {
+		fs.unplacePlaylistTrack(loaded, i)
+	}
+	loaded.name, loaded.nodes = "", nil
+}
+
+// unplacePlaylistTrack removes the node placed for the track at index i of a
+// playlist, unless it has already gone with its entry. It must be called with
+// fs.lock held.
+func (fs *FS) unplacePlaylistTrack(loaded *loadedPlaylist, i int) {
+	node := loaded.nodes[i]
+	if node == nil {
+		return
+	}
+	loaded.nodes[i] = nil
+
+	key := node.entry.File.FullPath()
+	nodes := fs.nodes[key]
+	for j := range nodes {
+		if nodes[j] == node {
+			keep := make([]*fileNode, 0, len(nodes)-1)
+			keep = append(append(keep, nodes[:j]...), nodes[j+1:]...)
+			fs.nodes[key] = keep
+			fs.removeNodes([]*fileNode{node})
+			return
+		}
+	}
+}
+
+// hasNode reports whether file is still one of the nodes placed for its
+// entry. It must be called with fs.lock held.
+func (fs *FS) hasNode(file *fileNode) bool {
+	for _, node := range fs.nodes[file.entry.File.FullPath()] {
+		if node == file {
+			return true
+		}
+	}
+	return false
+}
+
+// placePlaylist removes every node previously placed for a playlist, then
+// resolves its tracks and places them in ViewPlaylists again, named for
+// their position in the playlist. If other playlists share the playlist's
+// name, a hash of its path is added to the name to keep them apart.
+func (fs *FS) placePlaylist(loaded *loadedPlaylist) error {
+	fs.unplacePlaylist(loaded)
+	if !fs.hasView(&FileEntry{File: loaded.file}, ViewPlaylists) {
+		return nil
+	}
+
+	name := loaded.base
+	if len(fs.playlistNames[loaded.base]) > 1 {
+		name = fmt.Sprintf("%s [%s]", name, pathHash(loaded.file))
+	}
+	loaded.name, loaded.nodes = name, make([]*fileNode, len(loaded.tracks))
+	for i := range loaded.tracks {
+		if err := fs.placePlaylistTrack(loaded, i); err != nil {
+			return err
+		}
+	}
+	return fs.placeUnresolved(loaded)
+}
+
+// placePlaylistTrack resolves the track at index i of a placed playlist, and
+// places it in ViewPlaylists if it can be found. The node placed for it
+// before is kept if it is still right, or replaced otherwise. It must be
+// called with fs.lock held.
+func (fs *FS) placePlaylistTrack(loaded *loadedPlaylist, i int) error {
+	entry, match := fs.resolvePlaylistTrack(loaded.file, loaded.tracks[i])
+	if entry == nil {
+		fs.unplacePlaylistTrack(loaded, i)
+		return nil
+	}
+	name := loaded.trackNum(i) + " " + fs.playlistTrackName(entry)
+
+	if old := loaded.nodes[i]; old != nil && old.entry == entry && *old.match == *match &&
+		old.base == sanitisePart.ReplaceAllString(name, "_") && fs.hasNode(old) {
+		return nil
+	}
+	fs.unplacePlaylistTrack(loaded, i)
+	node, err := fs.addMatchedNode(ViewPlaylists, name, entry, match, ViewPlaylists, loaded.name)
+	if err != nil {
+		return err
+	}
+	loaded.nodes[i] = node
+	return nil
+}
+
+// trackNum returns the number the track at index i is named with, padded to
+// the same width for every track in the playlist.
+func (loaded *loadedPlaylist) trackNum(i int) string {
+	width := len(strconv.Itoa(len(loaded.tracks)))
+	if width < 3 {
+		width = 3
+	}
+	return fmt.Sprintf("%0*d", width, i+1)
+}
+
+// placeUnresolved replaces the file listing the tracks of a placed playlist
+// that couldn't be resolved, if the list has changed. It must be called with
+// fs.lock held.
+func (fs *FS) placeUnresolved(loaded *loadedPlaylist) error {
+	var unresolved bytes.Buffer
+	for i, track := range loaded.tracks {
+		if loaded.nodes[i] == nil {
+			if desc := track.String(); desc != "" {
+				fmt.Fprintln(&unresolved, loaded.trackNum(i), desc)
+			}
+		}
+	}
+	if loaded.unresolved != nil && bytes.Equal(loaded.unresolved.data, unresolved.Bytes()) {
+		return nil
+	}
+	fs.unplaceUnresolved(loaded)
+	if unresolved.Len() == 0 {
+		return nil
+	}
+
+	dir, err := fs.mkdirAll(ViewPlaylists)
+	if err != nil {
+		return err
+	}
+	textName := sanitisePart.ReplaceAllString(loaded.name, "_") + UnresolvedSuffix
+	if _, ok := dir.index[textName]; !ok {
+		loaded.unresolved = &textNode{inode: fs.inode(dir.childPath(textName), nil), name: textName, data: unresolved.Bytes()}
+		loaded.unresolvedDir = dir
+		dir.addText(loaded.unresolved)
+		fs.pending = append(fs.pending, invalidation{dir, textName})
+	}
+	return nil
+}
+
+func (fs *FS) unplaceUnresolved(loaded *loadedPlaylist) {
+	if loaded.unresolved == nil {
+		return
+	}
+	dir := loaded.unresolvedDir
+	dir.removeText(loaded.unresolved)
+	fs.pending = append(fs.pending, invalidation{dir, loaded.unresolved.name})
+	fs.prune(dir)
+	loaded.unresolved, loaded.unresolvedDir = nil, nil
+}
+
+// playlistTrackName returns "Artist - Title" for entry, or the name of its
+// file if it doesn't have a title.
+func (fs *FS) playlistTrackName(entry *FileEntry) string {
+	meta := entry.Metadata
+	if entry.Err != "" || meta == nil || meta.Title == "" {
+		return trimExt(filepath.Base(entry.File.Path), "")
+	}
+	if meta.Artist == "" {
+		return meta.Title
+	}
+	return fs.names.display(nameArtist, meta.Artist) + " - " + meta.Title
+}
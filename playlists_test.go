@@ -0,0 +1,132 @@
+package musefuse
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFSPlaylists(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "musefuse-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := os.Mkdir(filepath.Join(tmp, "lists"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	m3u := "#EXTM3U\n" +
+		filepath.Join(tmp, "Foo/X/01 a.mp3") + "\n" + // Absolute
+		"../Foo/X/02 b.mp3\n" + // Relative to the playlist
+		"/mnt/old/Foo/Y/01 c.mp3\n" + // Another root
+		"/mnt/old/Baz/Z/01 c.mp3\n" + // Ambiguous
+		"missing.mp3\n"
+	if err := ioutil.WriteFile(filepath.Join(tmp, "lists", "mix.m3u"), []byte(m3u), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewFS()
+	entry := func(path, title string) *FileEntry {
+		return &FileEntry{
+			File:     FileInfo{Prefix: tmp, Path: path, Kind: FileAudio},
+			Metadata: &Metadata{Artist: "Foo", Title: title},
+		}
+	}
+	a := entry("Foo/X/01 a.mp3", "A")
+	for _, e := range []*FileEntry{a, entry("Foo/X/02 b.mp3", "B"), entry("Foo/Y/01 c.mp3", "C"), entry("Bar/Y/01 c.mp3", "C")} {
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.AddPlaylist(FileInfo{Prefix: tmp, Path: "lists/mix.m3u", Kind: FilePlaylist}); err != nil {
+		t.Fatal(err)
+	}
+
+	unresolved := func() string {
+		text, ok := fs.lookup("playlists/mix" + UnresolvedSuffix).(*textNode)
+		if !ok {
+			t.Fatal("expected unresolved file")
+		}
+		bts, _ := text.ReadAll(context.Background())
+		return string(bts)
+	}
+
+	for _, path := range []string{"001 Foo - A.mp3", "002 Foo - B.mp3", "003 Foo - C.mp3"} {
+		file, ok := fs.lookup("playlists/mix/" + path).(*fileNode)
+		if !ok {
+			t.Fatal("expected file", path)
+		}
+		if path == "003 Foo - C.mp3" && file.entry.File.Path != "Foo/Y/01 c.mp3" {
+			t.Fatal("unexpected entry", file.entry.File.Path)
+		}
+	}
+	if s := unresolved(); s != "004 /mnt/old/Baz/Z/01 c.mp3\n005 missing.mp3\n" {
+		t.Fatalf("unexpected unresolved tracks %q", s)
+	}
+
+	// Only the tracks that could refer to the new file are resolved again:
+	b := fs.lookup("playlists/mix/002 Foo - B.mp3")
+	if err := fs.AddAudio(entry("lists/missing.mp3", "M")); err != nil {
+		t.Fatal(err)
+	}
+	if fs.lookup("playlists/mix/005 Foo - M.mp3") == nil {
+		t.Fatal("expected added track to be resolved")
+	}
+	if fs.lookup("playlists/mix/002 Foo - B.mp3") != b {
+		t.Fatal("expected other tracks to stay put")
+	}
+	fs.RemoveAudio(a.File.FullPath())
+	if fs.lookup("playlists/mix/001 Foo - A.mp3") != nil {
+		t.Fatal("expected removed track to be gone")
+	}
+	if s := unresolved(); s != "001 "+filepath.Join(tmp, "Foo/X/01 a.mp3")+"\n004 /mnt/old/Baz/Z/01 c.mp3\n" {
+		t.Fatalf("unexpected unresolved tracks %q", s)
+	}
+
+	fs.RemovePlaylist(filepath.Join(tmp, "lists/mix.m3u"))
+	if fs.lookup(ViewPlaylists) != nil {
+		t.Fatal("expected playlists to be pruned")
+	}
+}
+
+func TestFSPlaylistsWindowsPaths(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "musefuse-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := os.Mkdir(filepath.Join(tmp, "lists"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	m3u := "#EXTM3U\r\n" +
+		"..\\Foo\\X\\01 a.mp3\r\n" + // Relative to the playlist
+		"C:\\Music\\Foo\\X\\02 b.mp3\r\n" // Another machine
+	if err := ioutil.WriteFile(filepath.Join(tmp, "lists", "win.m3u8"), []byte(m3u), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewFS()
+	for _, e := range []*FileEntry{
+		{File: FileInfo{Prefix: tmp, Path: "Foo/X/01 a.mp3", Kind: FileAudio}, Metadata: &Metadata{Artist: "Foo", Title: "A"}},
+		{File: FileInfo{Prefix: tmp, Path: "Foo/X/02 b.mp3", Kind: FileAudio}, Metadata: &Metadata{Artist: "Foo", Title: "B"}},
+	} {
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.AddPlaylist(FileInfo{Prefix: tmp, Path: "lists/win.m3u8", Kind: FilePlaylist}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"001 Foo - A.mp3", "002 Foo - B.mp3"} {
+		if fs.lookup("playlists/win/"+path) == nil {
+			t.Fatal("expected file", path)
+		}
+	}
+	if fs.lookup("playlists/win"+UnresolvedSuffix) != nil {
+		t.Fatal("expected every track to be resolved")
+	}
+}
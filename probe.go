@@ -0,0 +1,378 @@
+package musefuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/dhowden/tag"
+)
+
+// Audio properties, as set in Metadata by ProbeAudio.
+const (
+	CodecAAC    = "AAC"
+	CodecALAC   = "ALAC"
+	CodecFLAC   = "FLAC"
+	CodecMP3    = "MP3"
+	CodecOpus   = "Opus"
+	CodecVorbis = "Vorbis"
+)
+
+// ProbeAudio reads the properties of the audio stream in r, such as its
+// duration and bitrate, into meta. meta.FileType must already be set, as it
+// is by MetadataFromTag. Formats ProbeAudio doesn't understand are left
+// alone.
+func ProbeAudio(r io.ReadSeeker, meta *Metadata) error {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	switch meta.FileType {
+	case tag.FLAC:
+		err = probeFLAC(r, meta)
+	case tag.OGG:
+		err = probeOgg(r, size, meta)
+	case tag.MP3:
+		err = probeMP3(r, size, meta)
+	case tag.M4A, tag.M4B, tag.M4P, tag.ALAC:
+		err = probeMP4(r, size, meta)
+	}
+	if err != nil {
+		return err
+	}
+
+	if meta.Bitrate == 0 && meta.Duration > 0 {
+		meta.Bitrate = kbps(size, meta.Duration)
+	}
+	return nil
+}
+
+// samplesDuration returns how long n samples at rate per second take.
+func samplesDuration(n, rate int64) time.Duration {
+	return time.Duration(float64(n) / float64(rate) * float64(time.Second))
+}
+
+// kbps returns the bitrate of size bytes played over dur.
+func kbps(size int64, dur time.Duration) int {
+	return int(float64(size) * 8 / dur.Seconds() / 1000)
+}
+
+func probeFLAC(r io.ReadSeeker, meta *Metadata) error {
+	if err := skipID3(r); err != nil {
+		return err
+	}
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if string(hdr[:4]) != "fLaC" || hdr[4]&0x7f != 0 {
+		return fmt.Errorf("musefuse: expected FLAC STREAMINFO")
+	}
+
+	var info [34]byte
+	if _, err := io.ReadFull(r, info[:]); err != nil {
+		return err
+	}
+	// 20 bits of sample rate, 3 of channels-1, 5 of bits per sample-1 and 36
+	// of total samples:
+	bits := binary.BigEndian.Uint64(info[10:18])
+	rate := int(bits >> 44)
+	samples := int64(bits & (1<<36 - 1))
+
+	meta.Codec, meta.Lossless = CodecFLAC, true
+	meta.SampleRate = rate
+	meta.Channels = int(bits>>41&0x7) + 1
+	meta.BitsPerSample = int(bits>>36&0x1f) + 1
+	if rate > 0 {
+		meta.Duration = samplesDuration(samples, int64(rate))
+	}
+	return nil
+}
+
+// oggTail is how far from the end of an Ogg file probeOgg looks for the last
+// page, which has the stream's length.
+const oggTail = 64 << 10
+
+func probeOgg(r io.ReadSeeker, size int64, meta *Metadata) error {
+	var hdr [27]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if string(hdr[:4]) != "OggS" {
+		return fmt.Errorf("musefuse: expected 'OggS', found %q", hdr[:4])
+	}
+	serial := binary.LittleEndian.Uint32(hdr[14:18])
+	segments, err := readBlock(r, int(hdr[26]))
+	if err != nil {
+		return err
+	}
+	var packetSize int
+	for _, seg := range segments {
+		packetSize += int(seg)
+		if seg < 255 {
+			break
+		}
+	}
+	packet, err := readBlock(r, packetSize)
+	if err != nil {
+		return err
+	}
+
+	var rate, skip int64
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 28:
+		meta.Codec = CodecVorbis
+		meta.Channels = int(packet[11])
+		rate = int64(binary.LittleEndian.Uint32(packet[12:16]))
+		meta.SampleRate = int(rate)
+		if nominal := int32(binary.LittleEndian.Uint32(packet[20:24])); nominal > 0 {
+			meta.Bitrate = int(nominal / 1000)
+		}
+
+	case bytes.HasPrefix(packet, []byte("OpusHead")) && len(packet) >= 16:
+		// Opus is always decoded at 48kHz, whatever the input rate was:
+		meta.Codec = CodecOpus
+		meta.Channels = int(packet[9])
+		skip = int64(binary.LittleEndian.Uint16(packet[10:12]))
+		rate = 48000
+		meta.SampleRate = int(binary.LittleEndian.Uint32(packet[12:16]))
+		if meta.SampleRate == 0 {
+			meta.SampleRate = 48000
+		}
+
+	default:
+		return fmt.Errorf("musefuse: unknown Ogg stream")
+	}
+
+	// The granule position of the last page is the number of samples:
+	start := size - oggTail
+	if start < 0 {
+		start = 0
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	tail, err := ioutil.ReadAll(io.LimitReader(r, oggTail))
+	if err != nil {
+		return err
+	}
+	for i := len(tail) - 27; i >= 0; i-- {
+		if tail[i] != 'O' || string(tail[i:i+4]) != "OggS" || binary.LittleEndian.Uint32(tail[i+14:i+18]) != serial {
+			continue
+		}
+		granule := int64(binary.LittleEndian.Uint64(tail[i+6 : i+14]))
+		if granule > skip {
+			meta.Duration = samplesDuration(granule-skip, rate)
+		}
+		break
+	}
+	return nil
+}
+
+var mp3Bitrates = [2][3][16]int{
+	{ // MPEG 1, layers I, II and III
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	{ // MPEG 2 and 2.5
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+var mp3SampleRates = [3][3]int{
+	{44100, 48000, 32000}, // MPEG 1
+	{22050, 24000, 16000}, // MPEG 2
+	{11025, 12000, 8000},  // MPEG 2.5
+}
+
+// mp3Search limits how far past the tags probeMP3 looks for the first frame.
+const mp3Search = 64 << 10
+
+func probeMP3(r io.ReadSeeker, size int64, meta *Metadata) error {
+	if err := skipID3(r); err != nil {
+		return err
+	}
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(r, mp3Search))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xff || buf[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+		h := binary.BigEndian.Uint32(buf[i:])
+		version := h >> 19 & 0x3 // 0: 2.5, 2: 2, 3: 1
+		layer := 4 - int(h>>17&0x3)
+		bitrateIdx, rateIdx := h>>12&0xf, h>>10&0x3
+		if version == 1 || layer == 4 || bitrateIdx == 0 || bitrateIdx == 15 || rateIdx == 3 {
+			continue
+		}
+
+		mpeg, table := 0, 0
+		switch version {
+		case 2:
+			mpeg, table = 1, 1
+		case 0:
+			mpeg, table = 2, 1
+		}
+		rate := mp3SampleRates[mpeg][rateIdx]
+		channels := 2
+		if h>>6&0x3 == 3 {
+			channels = 1
+		}
+		samplesPerFrame := 1152
+		if layer == 1 {
+			samplesPerFrame = 384
+		} else if layer == 3 && mpeg > 0 {
+			samplesPerFrame = 576
+		}
+
+		meta.Codec = CodecMP3
+		meta.SampleRate = rate
+		meta.Channels = channels
+		meta.Bitrate = mp3Bitrates[table][layer-1][bitrateIdx]
+
+		// A Xing (or "Info") header follows the side information of the first
+		// frame in VBR files, a VBRI header always starts 32 bytes in:
+		frame := buf[i:]
+		sideInfo := 32
+		if mpeg > 0 && channels == 1 {
+			sideInfo = 9
+		} else if mpeg > 0 || channels == 1 {
+			sideInfo = 17
+		}
+		var frames, length int64
+		if x := 4 + sideInfo; len(frame) >= x+16 && (string(frame[x:x+4]) == "Xing" || string(frame[x:x+4]) == "Info") {
+			flags := binary.BigEndian.Uint32(frame[x+4:])
+			off := x + 8
+			if flags&1 != 0 {
+				frames = int64(binary.BigEndian.Uint32(frame[off:]))
+				off += 4
+			}
+			if flags&2 != 0 && len(frame) >= off+4 {
+				length = int64(binary.BigEndian.Uint32(frame[off:]))
+			}
+		} else if len(frame) >= 36+18 && string(frame[36:40]) == "VBRI" {
+			length = int64(binary.BigEndian.Uint32(frame[46:]))
+			frames = int64(binary.BigEndian.Uint32(frame[50:]))
+		}
+
+		if frames > 0 {
+			meta.Duration = samplesDuration(frames*int64(samplesPerFrame), int64(rate))
+			if length > 0 {
+				meta.Bitrate = kbps(length, meta.Duration)
+			}
+		} else {
+			// Constant bitrate, so the length follows from the size:
+			audio := size - start - int64(i)
+			if _, err := r.Seek(size-128, io.SeekStart); err == nil {
+				var id3v1 [3]byte
+				if _, err := io.ReadFull(r, id3v1[:]); err == nil && string(id3v1[:]) == "TAG" {
+					audio -= 128
+				}
+			}
+			// Bits at the bitrate, just like samples at a sample rate:
+			meta.Duration = samplesDuration(audio*8, int64(meta.Bitrate)*1000)
+		}
+		return nil
+	}
+	return fmt.Errorf("musefuse: no MP3 frame found")
+}
+
+// mp4Containers are the atoms probeMP4 descends into.
+var mp4Containers = map[string]bool{"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true}
+
+// probeMP4 reads the atoms from the current position up to end.
+func probeMP4(r io.ReadSeeker, end int64, meta *Metadata) error {
+	for {
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if pos+8 > end {
+			return nil
+		}
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return err
+		}
+		atomSize, name := int64(binary.BigEndian.Uint32(hdr[:4])), string(hdr[4:])
+		bodyStart := pos + 8
+		switch atomSize {
+		case 0:
+			atomSize = end - pos
+		case 1:
+			var ext [8]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return err
+			}
+			atomSize = int64(binary.BigEndian.Uint64(ext[:]))
+			bodyStart += 8
+		}
+		atomEnd := pos + atomSize
+		if atomSize < 8 || atomEnd > end {
+			return fmt.Errorf("musefuse: bad MP4 atom %q", name)
+		}
+
+		switch {
+		case mp4Containers[name]:
+			if err := probeMP4(r, atomEnd, meta); err != nil {
+				return err
+			}
+		case name == "mvhd":
+			body, err := readBlock(r, int(atomEnd-bodyStart))
+			if err != nil {
+				return err
+			}
+			var scale, duration int64
+			if len(body) >= 32 && body[0] == 1 {
+				scale, duration = int64(binary.BigEndian.Uint32(body[20:])), int64(binary.BigEndian.Uint64(body[24:]))
+			} else if len(body) >= 20 {
+				scale, duration = int64(binary.BigEndian.Uint32(body[12:])), int64(binary.BigEndian.Uint32(body[16:]))
+			}
+			if scale > 0 {
+				meta.Duration = samplesDuration(duration, scale)
+			}
+		case name == "stsd" && meta.Codec == "":
+			body, err := readBlock(r, int(atomEnd-bodyStart))
+			if err != nil {
+				return err
+			}
+			// Version and flags, the entry count, then the first entry's
+			// size and format, and the audio sample entry:
+			if len(body) < 44 {
+				break
+			}
+			switch string(body[12:16]) {
+			case "mp4a":
+				meta.Codec = CodecAAC
+			case "alac":
+				meta.Codec, meta.Lossless = CodecALAC, true
+			}
+			if meta.Codec != "" {
+				meta.Channels = int(binary.BigEndian.Uint16(body[32:]))
+				meta.BitsPerSample = int(binary.BigEndian.Uint16(body[34:]))
+				meta.SampleRate = int(binary.BigEndian.Uint32(body[40:]) >> 16)
+			}
+		}
+
+		if _, err := r.Seek(atomEnd, io.SeekStart); err != nil {
+			return err
+		}
+	}
+}
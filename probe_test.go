@@ -0,0 +1,147 @@
+package musefuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/dhowden/tag"
+)
+
+func TestProbeFLAC(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("fLaC")
+	buf.Write([]byte{0x80, 0, 0, 34})
+	info := make([]byte, 34)
+	// 44100Hz, 2 channels, 16 bits, 441000 samples:
+	binary.BigEndian.PutUint64(info[10:], 44100<<44|1<<41|15<<36|441000)
+	buf.Write(info)
+
+	meta := &Metadata{FileType: tag.FLAC}
+	if err := ProbeAudio(bytes.NewReader(buf.Bytes()), meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Codec != CodecFLAC || !meta.Lossless || meta.SampleRate != 44100 || meta.Channels != 2 || meta.BitsPerSample != 16 || meta.Duration != 10*time.Second {
+		t.Fatalf("%+v", meta)
+	}
+}
+
+func oggPage(serial uint32, granule uint64, packet []byte) []byte {
+	hdr := make([]byte, 27)
+	copy(hdr, "OggS")
+	binary.LittleEndian.PutUint64(hdr[6:], granule)
+	binary.LittleEndian.PutUint32(hdr[14:], serial)
+	hdr[26] = 1
+	return append(append(hdr, byte(len(packet))), packet...)
+}
+
+func TestProbeOgg(t *testing.T) {
+	opus := make([]byte, 19)
+	copy(opus, "OpusHead")
+	opus[9] = 2
+	binary.LittleEndian.PutUint16(opus[10:], 312)
+	binary.LittleEndian.PutUint32(opus[12:], 44100)
+
+	var buf bytes.Buffer
+	buf.Write(oggPage(7, 0, opus))
+	buf.Write(oggPage(7, 48000*3, []byte("audio")))
+	buf.Write(oggPage(8, 48000*100, []byte("another stream")))
+	buf.Write(oggPage(7, 48000*5+312, []byte("audio")))
+
+	meta := &Metadata{FileType: tag.OGG}
+	if err := ProbeAudio(bytes.NewReader(buf.Bytes()), meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Codec != CodecOpus || meta.SampleRate != 44100 || meta.Channels != 2 || meta.Duration != 5*time.Second {
+		t.Fatalf("%+v", meta)
+	}
+}
+
+func TestProbeMP3(t *testing.T) {
+	// MPEG 1 layer III, 128kbit/s, 44100Hz, stereo:
+	frameHeader := []byte{0xff, 0xfb, 0x90, 0x00}
+
+	t.Run("xing", func(t *testing.T) {
+		frame := make([]byte, 417)
+		copy(frame, frameHeader)
+		copy(frame[36:], "Xing")
+		binary.BigEndian.PutUint32(frame[40:], 3) // Frames and bytes
+		binary.BigEndian.PutUint32(frame[44:], 3828)
+		binary.BigEndian.PutUint32(frame[48:], 2000000)
+
+		meta := &Metadata{FileType: tag.MP3}
+		if err := ProbeAudio(bytes.NewReader(frame), meta); err != nil {
+			t.Fatal(err)
+		}
+		// 3828 frames of 1152 samples:
+		if meta.Codec != CodecMP3 || meta.Duration.Round(time.Millisecond) != 99997*time.Millisecond || meta.Bitrate != 160 {
+			t.Fatalf("%+v", meta)
+		}
+	})
+
+	t.Run("cbr", func(t *testing.T) {
+		data := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x02\x00\x00"), frameHeader...)
+		data = append(data, make([]byte, 160000-4)...)
+		data = append(data, []byte("TAG")...)
+		data = append(data, make([]byte, 125)...)
+
+		meta := &Metadata{FileType: tag.MP3}
+		if err := ProbeAudio(bytes.NewReader(data), meta); err != nil {
+			t.Fatal(err)
+		}
+		if meta.Bitrate != 128 || meta.SampleRate != 44100 || meta.Duration != 10*time.Second {
+			t.Fatalf("%+v", meta)
+		}
+	})
+}
+
+func TestProbeMP4(t *testing.T) {
+	atom := func(name string, body ...[]byte) []byte {
+		data := bytes.Join(body, nil)
+		out := make([]byte, 8, 8+len(data))
+		binary.BigEndian.PutUint32(out, uint32(8+len(data)))
+		copy(out[4:], name)
+		return append(out, data...)
+	}
+
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 180500)
+
+	stsd := make([]byte, 44)
+	binary.BigEndian.PutUint32(stsd[4:], 1)
+	copy(stsd[12:], "alac")
+	binary.BigEndian.PutUint16(stsd[32:], 2)
+	binary.BigEndian.PutUint16(stsd[34:], 24)
+	binary.BigEndian.PutUint32(stsd[40:], 48000<<16)
+
+	file := append(atom("ftyp", []byte("M4A \x00\x00\x00\x00")),
+		atom("moov", atom("mvhd", mvhd), atom("trak", atom("mdia", atom("minf", atom("stbl", atom("stsd", stsd))))))...)
+
+	meta := &Metadata{FileType: tag.M4A}
+	if err := ProbeAudio(bytes.NewReader(file), meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Codec != CodecALAC || !meta.Lossless || meta.Channels != 2 || meta.BitsPerSample != 24 || meta.SampleRate != 48000 || meta.Duration != 180500*time.Millisecond {
+		t.Fatalf("%+v", meta)
+	}
+}
+
+func TestFormatQuality(t *testing.T) {
+	for idx, tc := range []struct {
+		meta *Metadata
+		out  string
+	}{
+		{&Metadata{Lossless: true, Bitrate: 900}, "lossless"},
+		{&Metadata{Bitrate: 320}, "320k"},
+		{&Metadata{Bitrate: 245}, "256k"},
+		{&Metadata{Bitrate: 190}, "192k"},
+		{&Metadata{Bitrate: 32}, "64k"},
+		{&Metadata{}, ""},
+	} {
+		if out := formatQuality(tc.meta); out != tc.out {
+			t.Fatal(idx, out)
+		}
+	}
+}
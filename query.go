@@ -0,0 +1,371 @@
+package musefuse
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Query is a predicate over FileEntries, parsed from a small query language:
+//
+//	genre=jazz AND year>=1960 AND year<1970
+//	artist~"miles" OR (album=~^Kind AND NOT track=1)
+//
+// Comparisons are <field><op><value>. Operators are:
+//
+//	=   equal (case insensitive)
+//	!=  not equal
+//	<, <=, >, >=  numeric for numeric fields, otherwise string comparison
+//	~   contains (case insensitive)
+//	=~  matches regular expression
+//
+// Values may be quoted with single or double quotes if they contain spaces or
+// parentheses. Comparisons may be combined with AND, OR, NOT and parentheses;
+// AND binds tighter than OR. Keywords are case insensitive.
+type Query interface {
+	Match(entry *FileEntry) bool
+	String() string
+}
+
+type queryField struct {
+	numeric bool
+	str     func(entry *FileEntry) string
+	num     func(entry *FileEntry) int
+}
+
+func metaStr(fn func(meta *Metadata) string) func(entry *FileEntry) string {
+	return func(entry *FileEntry) string {
+		if entry.Metadata == nil {
+			return ""
+		}
+		return fn(entry.Metadata)
+	}
+}
+
+func metaNum(fn func(meta *Metadata) int) func(entry *FileEntry) int {
+	return func(entry *FileEntry) int {
+		if entry.Metadata == nil {
+			return 0
+		}
+		return fn(entry.Metadata)
+	}
+}
+
+var queryFields = map[string]queryField{
+	"title":       {str: metaStr(func(m *Metadata) string { return m.Title })},
+	"album":       {str: metaStr(func(m *Metadata) string { return m.Album })},
+	"artist":      {str: metaStr(func(m *Metadata) string { return m.Artist })},
+	"albumartist": {str: metaStr(func(m *Metadata) string { return m.AlbumArtist })},
+	"composer":    {str: metaStr(func(m *Metadata) string { return m.Composer })},
+	"genre":       {str: metaStr(func(m *Metadata) string { return m.Genre })},
+	"comment":     {str: metaStr(func(m *Metadata) string { return m.Comment })},
+	"format":      {str: metaStr(func(m *Metadata) string { return string(m.Format) })},
+	"filetype":    {str: metaStr(func(m *Metadata) string { return string(m.FileType) })},
+	"year":        {numeric: true, num: metaNum(func(m *Metadata) int { return m.Year })},
+	"track":       {numeric: true, num: metaNum(func(m *Metadata) int { return m.Track })},
+	"tracks":      {numeric: true, num: metaNum(func(m *Metadata) int { return m.Tracks })},
+	"disc":        {numeric: true, num: metaNum(func(m *Metadata) int { return m.Disc })},
+	"discs":       {numeric: true, num: metaNum(func(m *Metadata) int { return m.Discs })},
+	"codec":       {str: metaStr(func(m *Metadata) string { return m.Codec })},
+	"duration":    {numeric: true, num: metaNum(func(m *Metadata) int { return int(m.Duration.Seconds()) })},
+	"bitrate":     {numeric: true, num: metaNum(func(m *Metadata) int { return m.Bitrate })},
+	"samplerate":  {numeric: true, num: metaNum(func(m *Metadata) int { return m.SampleRate })},
+	"channels":    {numeric: true, num: metaNum(func(m *Metadata) int { return m.Channels })},
+	"recordingid": {str: metaStr(func(m *Metadata) string { return m.MusicBrainz.Recording })},
+	"releaseid":   {str: metaStr(func(m *Metadata) string { return m.MusicBrainz.Release })},
+	"path":        {str: func(e *FileEntry) string { return e.File.Path }},
+	"database":    {str: func(e *FileEntry) string { return e.File.Database }},
+	"error":       {str: func(e *FileEntry) string { return e.Err }},
+}
+
+// QueryFields returns the names of the fields that can be used in a Query.
+func QueryFields() []string {
+	names := make([]string, 0, len(queryFields))
+	for name := range queryFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type queryAnd struct{ left, right Query }
+type queryOr struct{ left, right Query }
+type queryNot struct{ inner Query }
+
+func (q *queryAnd) Match(e *FileEntry) bool { return q.left.Match(e) && q.right.Match(e) }
+func (q *queryOr) Match(e *FileEntry) bool  { return q.left.Match(e) || q.right.Match(e) }
+func (q *queryNot) Match(e *FileEntry) bool { return !q.inner.Match(e) }
+
+func (q *queryAnd) String() string { return fmt.Sprintf("(%s AND %s)", q.left, q.right) }
+func (q *queryOr) String() string  { return fmt.Sprintf("(%s OR %s)", q.left, q.right) }
+func (q *queryNot) String() string { return fmt.Sprintf("NOT %s", q.inner) }
+
+type queryCompare struct {
+	name  string
+	field queryField
+	op    string
+	value string
+	num   int
+	re    *regexp.Regexp
+}
+
+func (q *queryCompare) String() string {
+	return fmt.Sprintf("%s%s%q", q.name, q.op, q.value)
+}
+
+func (q *queryCompare) Match(e *FileEntry) bool {
+	if q.op == "=~" {
+		return q.re.MatchString(q.fieldString(e))
+	}
+
+	if q.field.numeric {
+		v := q.field.num(e)
+		switch q.op {
+		case "=":
+			return v == q.num
+		case "!=":
+			return v != q.num
+		case "<":
+			return v < q.num
+		case "<=":
+			return v <= q.num
+		case ">":
+			return v > q.num
+		case ">=":
+			return v >= q.num
+		case "~":
+			return strings.Contains(strconv.Itoa(v), q.value)
+		}
+		return false
+	}
+
+	v := q.field.str(e)
+	switch q.op {
+	case "=":
+		return strings.EqualFold(v, q.value)
+	case "!=":
+		return !strings.EqualFold(v, q.value)
+	case "~":
+		return strings.Contains(strings.ToLower(v), strings.ToLower(q.value))
+	}
+
+	cmp := strings.Compare(strings.ToLower(v), strings.ToLower(q.value))
+	switch q.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func (q *queryCompare) fieldString(e *FileEntry) string {
+	if q.field.numeric {
+		return strconv.Itoa(q.field.num(e))
+	}
+	return q.field.str(e)
+}
+
+type queryToken struct {
+	kind  byte // 'w'ord, 's'tring, '(' or ')'
+	value string
+	pos   int
+}
+
+type queryParser struct {
+	src    string
+	tokens []queryToken
+	pos    int
+}
+
+// ParseQuery parses a Query from s; see Query for the syntax.
+func ParseQuery(s string) (Query, error) {
+	p := &queryParser{src: s}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("musefuse: empty query")
+	}
+
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf(p.tokens[p.pos], "unexpected %q", p.tokens[p.pos].value)
+	}
+	return q, nil
+}
+
+func (p *queryParser) errorf(tok queryToken, msg string, args ...interface{}) error {
+	return fmt.Errorf("musefuse: query %q at position %d: %s", p.src, tok.pos+1, fmt.Sprintf(msg, args...))
+}
+
+// lex splits the query into words, quoted strings and parens. A comparison
+// like 'artist="Miles Davis"' is lexed as the word 'artist=' followed by a
+// string; parseCompare glues them back together.
+func (p *queryParser) lex() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+
+		case c == '(' || c == ')':
+			p.tokens = append(p.tokens, queryToken{kind: c, value: string(c), pos: i})
+			i++
+
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return fmt.Errorf("musefuse: query %q at position %d: unterminated string", s, i+1)
+			}
+			p.tokens = append(p.tokens, queryToken{kind: 's', value: s[i+1 : i+1+end], pos: i})
+			i += end + 2
+
+		default:
+			start := i
+			for i < len(s) && !unicode.IsSpace(rune(s[i])) && s[i] != '(' && s[i] != ')' && s[i] != '"' && s[i] != '\'' {
+				i++
+			}
+			p.tokens = append(p.tokens, queryToken{kind: 'w', value: s[start:i], pos: start})
+		}
+	}
+	return nil
+}
+
+func (p *queryParser) peekKeyword(kw string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == 'w' && strings.EqualFold(p.tokens[p.pos].value, kw)
+}
+
+func (p *queryParser) parseOr() (Query, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &queryOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (Query, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("and") {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &queryAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseNot() (Query, error) {
+	if p.peekKeyword("not") {
+		p.pos++
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNot{inner}, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *queryParser) parseTerm() (Query, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("musefuse: query %q: unexpected end of query", p.src)
+	}
+
+	tok := p.tokens[p.pos]
+	if tok.kind == '(' {
+		p.pos++
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != ')' {
+			return nil, p.errorf(tok, "unclosed '('")
+		}
+		p.pos++
+		return q, nil
+	}
+	if tok.kind != 'w' {
+		return nil, p.errorf(tok, "expected a comparison, found %q", tok.value)
+	}
+	return p.parseCompare()
+}
+
+var queryOps = []string{"!=", "<=", ">=", "=~", "=", "<", ">", "~"}
+
+func (p *queryParser) parseCompare() (Query, error) {
+	tok := p.tokens[p.pos]
+	p.pos++
+
+	opIdx := strings.IndexAny(tok.value, "!=<>~")
+	if opIdx <= 0 {
+		return nil, p.errorf(tok, "expected a comparison like 'field=value', found %q", tok.value)
+	}
+
+	name := strings.ToLower(tok.value[:opIdx])
+	rest := tok.value[opIdx:]
+
+	var op string
+	for _, candidate := range queryOps {
+		if strings.HasPrefix(rest, candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return nil, p.errorf(tok, "unknown operator in %q", tok.value)
+	}
+	value := rest[len(op):]
+
+	// The value was quoted, so it was lexed as a separate token:
+	if value == "" && p.pos < len(p.tokens) && p.tokens[p.pos].kind == 's' && p.tokens[p.pos].pos == tok.pos+len(tok.value) {
+		value = p.tokens[p.pos].value
+		p.pos++
+	}
+
+	field, ok := queryFields[name]
+	if !ok {
+		return nil, p.errorf(tok, "unknown field %q, expected one of %s", name, strings.Join(QueryFields(), ", "))
+	}
+
+	q := &queryCompare{name: name, field: field, op: op, value: value}
+	if op == "=~" {
+		re, err := regexp.Compile("(?i)" + value)
+		if err != nil {
+			return nil, p.errorf(tok, "invalid regexp %q: %v", value, err)
+		}
+		q.re = re
+
+	} else if field.numeric && op != "~" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, p.errorf(tok, "field %q needs a number, found %q", name, value)
+		}
+		q.num = n
+	}
+	return q, nil
+}
@@ -0,0 +1,66 @@
+package musefuse
+
+import (
+	"testing"
+)
+
+func TestQueryMatch(t *testing.T) {
+	entry := testEntry("jazz/kind of blue/01.flac", &Metadata{
+		Artist: "Miles Davis",
+		Album:  "Kind of Blue",
+		Title:  "So What",
+		Genre:  "Jazz",
+		Year:   1959,
+		Track:  1,
+	})
+
+	for _, tc := range []struct {
+		query string
+		match bool
+	}{
+		{"genre=jazz", true},
+		{"genre!=jazz", false},
+		{"year>=1950 AND year<1960", true},
+		{"year>1959", false},
+		{"artist~davis", true},
+		{`artist="miles davis"`, true},
+		{`album='Kind of Blue' and track=1`, true},
+		{"title=~^so\\s", true},
+		{"title=~^what", false},
+		{"NOT genre=rock", true},
+		{"genre=rock OR year=1959", true},
+		{"genre=rock OR year=1959 AND track=2", false},
+		{"(genre=rock OR year=1959) AND NOT track=2", true},
+		{"path~kind", true},
+		{"artist<n AND artist>l", true},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			q, err := ParseQuery(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.Match(entry) != tc.match {
+				t.Fatalf("%s: expected %v", q, tc.match)
+			}
+		})
+	}
+}
+
+func TestQueryParseErrors(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"genre",
+		"nope=1",
+		"year=abc",
+		"title=~(",
+		"(genre=jazz",
+		"genre=jazz)",
+		"genre=jazz AND",
+		`artist="unterminated`,
+		"genre=jazz year=1",
+	} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("%q: expected error", query)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package musefuse
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/dhowden/tag"
+)
+
+// ReplayGain is the loudness normalisation for a track or album. Gain is in
+// dB, relative to the ReplayGain reference level; Peak is linear, where 1 is
+// full scale, and is zero if unknown.
+type ReplayGain struct {
+	Gain float64
+	Peak float64
+}
+
+// r128Offset converts the R128_*_GAIN tags used by Opus, which are relative to
+// -23 LUFS, to ReplayGain's reference level of -18 LUFS.
+const r128Offset = 5
+
+// replayGainFromRaw finds the ReplayGain tags in raw. They are in TXXX frames
+// in ID3v2, freeform "----:com.apple.iTunes" atoms in MP4 and comments in
+// Vorbis, all with much the same names, but of any case.
+func replayGainFromRaw(raw map[string]interface{}) (track, album *ReplayGain) {
+	values := map[string]string{}
+	for key, v := range raw {
+		if desc, text, ok := rawDescription(v); ok {
+			key, v = desc, text
+		}
+		if s, ok := rawTagString(v); ok {
+			values[strings.ToLower(key)] = s
+		}
+	}
+
+	get := func(scope string) *ReplayGain {
+		gain, ok := parseGain(values["replaygain_"+scope+"_gain"])
+		if !ok {
+			r128, err := strconv.Atoi(strings.TrimSpace(values["r128_"+scope+"_gain"]))
+			if err != nil {
+				return nil
+			}
+			// Q7.8 fixed point:
+			gain = float64(r128)/256 + r128Offset
+		}
+		rg := &ReplayGain{Gain: gain}
+		if peak, err := strconv.ParseFloat(strings.TrimSpace(values["replaygain_"+scope+"_peak"]), 64); err == nil {
+			rg.Peak = peak
+		}
+		return rg
+	}
+	return get("track"), get("album")
+}
+
+// rawDescription returns the description and text of a raw ID3v2 TXXX frame,
+// whether it is a *tag.Comm, or a map after being loaded from the Index.
+func rawDescription(v interface{}) (desc string, text string, ok bool) {
+	switch v := v.(type) {
+	case *tag.Comm:
+		return v.Description, v.Text, v.Description != ""
+	case map[string]interface{}:
+		desc, _ := v["Description"].(string)
+		text, _ := v["Text"].(string)
+		return desc, text, desc != ""
+	}
+	return "", "", false
+}
+
+// parseGain parses a gain like "-6.50 dB".
+func parseGain(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && strings.EqualFold(s[len(s)-2:], "db") {
+		s = strings.TrimSpace(s[:len(s)-2])
+	}
+	gain, err := strconv.ParseFloat(s, 64)
+	return gain, err == nil
+}
+
+// formatGain formats a gain like "-6.50 dB", as it is usually tagged.
+func formatGain(gain float64) string {
+	return strconv.FormatFloat(gain, 'f', 2, 64) + " dB"
+}
+
+// hasReplayGain reports whether a file has all the ReplayGain tags a player
+// needs to normalise it in either track or album mode.
+func hasReplayGain(meta *Metadata) bool {
+	return meta.TrackGain != nil && meta.AlbumGain != nil
+}
@@ -0,0 +1,106 @@
+package musefuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/dhowden/tag"
+)
+
+func TestReplayGainFromRaw(t *testing.T) {
+	for idx, tc := range []struct {
+		raw          map[string]interface{}
+		track, album float64
+		peak         float64
+		noAlbum      bool
+	}{
+		{ // Vorbis
+			raw:   map[string]interface{}{"replaygain_track_gain": "-6.50 dB", "replaygain_track_peak": "0.988", "replaygain_album_gain": "-7 dB"},
+			track: -6.5, album: -7, peak: 0.988,
+		},
+		{ // ID3v2 TXXX
+			raw: map[string]interface{}{
+				"TXXX":   &tag.Comm{Description: "REPLAYGAIN_TRACK_GAIN", Text: "+1.20 dB"},
+				"TXXX_0": &tag.Comm{Description: "REPLAYGAIN_ALBUM_GAIN", Text: "-2.00 dB"},
+			},
+			track: 1.2, album: -2,
+		},
+		{ // ID3v2 TXXX from the Index
+			raw:   map[string]interface{}{"TXXX": map[string]interface{}{"Description": "replaygain_track_gain", "Text": "-3.1 db"}},
+			track: -3.1, noAlbum: true,
+		},
+		{ // Opus, in Q7.8 relative to -23 LUFS
+			raw:   map[string]interface{}{"r128_track_gain": "-512", "r128_album_gain": "256"},
+			track: 3, album: 6,
+		},
+	} {
+		track, album := replayGainFromRaw(tc.raw)
+		if track == nil || math.Abs(track.Gain-tc.track) > 1e-9 || track.Peak != tc.peak {
+			t.Fatalf("%d: track %+v", idx, track)
+		}
+		if tc.noAlbum {
+			if album != nil {
+				t.Fatalf("%d: album %+v", idx, album)
+			}
+		} else if album == nil || math.Abs(album.Gain-tc.album) > 1e-9 {
+			t.Fatalf("%d: album %+v", idx, album)
+		}
+	}
+
+	if track, album := replayGainFromRaw(map[string]interface{}{"replaygain_track_gain": "loud"}); track != nil || album != nil {
+		t.Fatal(track, album)
+	}
+}
+
+func TestReadMetadataOpus(t *testing.T) {
+	opus := make([]byte, 19)
+	copy(opus, "OpusHead")
+	opus[9] = 1
+	binary.LittleEndian.PutUint32(opus[12:], 48000)
+	comments := append([]byte("OpusTags"), vorbisComments("TITLE=T", "ARTIST=A", "TRACKNUMBER=3/9", "DATE=2001-02-03", "R128_TRACK_GAIN=-1280")...)
+
+	var buf bytes.Buffer
+	buf.Write(oggPage(1, 0, opus))
+	buf.Write(oggPage(1, 0, comments))
+	buf.Write(oggPage(1, 48000*2, []byte("audio")))
+
+	meta, err := ReadMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "T" || meta.Artist != "A" || meta.Track != 3 || meta.Tracks != 9 || meta.Year != 2001 || meta.FileType != tag.OGG {
+		t.Fatalf("%+v", meta)
+	}
+	if meta.Codec != CodecOpus || meta.TrackGain == nil || meta.TrackGain.Gain != 0 || meta.AlbumGain != nil {
+		t.Fatalf("%+v", meta)
+	}
+}
+
+func TestFSNoReplayGainView(t *testing.T) {
+	fs := NewFS()
+	gain := &ReplayGain{Gain: -5}
+	done := testEntry("Foo/X/01 a.mp3", &Metadata{Artist: "Foo", Title: "A", Album: "X", TrackGain: gain, AlbumGain: gain})
+	half := testEntry("Foo/X/02 b.mp3", &Metadata{Artist: "Foo", Title: "B", Album: "X", TrackGain: gain})
+	none := testEntry("Foo/Y/01 c.mp3", &Metadata{Artist: "Foo", Title: "C", Album: "Y"})
+	for _, e := range []*FileEntry{done, half, none} {
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if fs.lookup("noreplaygain/default/Foo/X/01 a.mp3") != nil {
+		t.Fatal("unexpected file with ReplayGain")
+	}
+	for _, path := range []string{"noreplaygain/default/Foo/X/02 b.mp3", "noreplaygain/default/Foo/Y/01 c.mp3"} {
+		if _, ok := fs.lookup(path).(*fileNode); !ok {
+			t.Fatal("expected file", path)
+		}
+	}
+
+	fs.RemoveAudio(half.File.FullPath())
+	if fs.lookup("noreplaygain/default/Foo/X") != nil {
+		t.Fatal("expected dir to be pruned")
+	}
+}
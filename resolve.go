@@ -0,0 +1,352 @@
+package musefuse
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/shabbyrobe/musefuse/playlist"
+)
+
+// PlaylistMatch describes how a playlist track was matched to a file. The
+// web server shows it for files in ViewPlaylists.
+type PlaylistMatch struct {
+	// By is MatchPath, MatchIdentifier, MatchSuffix or MatchMetadata.
+	By string
+
+	// Confidence is from 0 to 1. Matches by path and identifier are 1.
+	Confidence float64
+}
+
+// The ways a playlist track can be matched to a file, in the order they are
+// tried. MatchSuffix and MatchMetadata are both tried, and the most confident
+// wins.
+const (
+	MatchPath       = "path"       // The path, or the path relative to the playlist
+	MatchIdentifier = "identifier" // A MusicBrainz recording or track ID
+	MatchSuffix     = "suffix"     // The end of the path, for another root
+	MatchMetadata   = "metadata"   // The title, artist, album, track and duration
+)
+
+const (
+	// minMatchConfidence is the lowest confidence a match by metadata can
+	// have, and minTitleSimilarity the lowest similarity of the titles.
+	minMatchConfidence = 0.8
+	minTitleSimilarity = 0.6
+
+	// Durations within durationTolerance of one another are the same, and
+	// beyond maxDurationDiff rule out a match.
+	durationTolerance = 3 * time.Second
+	maxDurationDiff   = 10 * time.Second
+
+	// ambiguousMatch is how close the two best matches by metadata have to
+	// be for the track to be left unresolved instead of guessing.
+	ambiguousMatch = 0.01
+)
+
+// playlistTrack is what musefuse keeps of a playlist.Track.
+type playlistTrack struct {
+	file string
+	info playlist.TrackInfo
+	refs []string
+}
+
+// newPlaylistTrack returns the track with the given file and info, and the
+// refs it can find entries by; see entryRefs.
+func newPlaylistTrack(file string, info playlist.TrackInfo) playlistTrack {
+	track := playlistTrack{file: file, info: info}
+	if file != "" {
+		track.refs = append(track.refs, "file:"+strings.ToLower(filepath.Base(filepath.FromSlash(file))))
+	}
+	for _, id := range parseMusicBrainzIDs(info.Identifier) {
+		track.refs = append(track.refs, "mbid:"+id)
+	}
+	for _, word := range titleWords(info.Title) {
+		track.refs = append(track.refs, "word:"+word)
+	}
+	return track
+}
+
+// String describes the track for the list of unresolved tracks.
+func (track playlistTrack) String() string {
+	switch info := track.info; {
+	case track.file != "":
+		return track.file
+	case info.Artist != "" && info.Title != "":
+		return info.Artist + " - " + info.Title
+	case info.Title != "":
+		return info.Title
+	}
+	return track.info.Identifier
+}
+
+// entryRefs returns the refs that playlist tracks can find entry by: the
+// lower case base name of its file, its MusicBrainz recording and track IDs,
+// and the words in its title. A track that shares none of them can't match.
+func entryRefs(entry *FileEntry) []string {
+	refs := []string{"file:" + strings.ToLower(filepath.Base(entry.File.FullPath()))}
+	if meta := entry.Metadata; meta != nil && entry.Err == "" {
+		for _, id := range []string{meta.MusicBrainz.Recording, meta.MusicBrainz.Track} {
+			if id != "" {
+				refs = append(refs, "mbid:"+id)
+			}
+		}
+		for _, word := range titleWords(meta.Title) {
+			refs = append(refs, "word:"+word)
+		}
+	}
+	return refs
+}
+
+// commonTitleWords turn up in so many titles that indexing them would find
+// most of the library, and have every change to it resolve most playlists
+// again.
+var commonTitleWords = map[string]bool{
+	"i": true, "i'm": true, "me": true, "my": true, "you": true, "your": true,
+	"we": true, "it": true, "is": true, "be": true, "to": true, "of": true,
+	"in": true, "on": true, "and": true, "for": true, "with": true, "do": true,
+	"don't": true, "love": true, "song": true, "baby": true, "night": true,
+	"remix": true, "mix": true, "edit": true, "version": true, "live": true,
+	"remaster": true, "remastered": true, "mono": true, "stereo": true,
+	"radio": true, "original": true, "instrumental": true, "demo": true,
+	"feat": true, "ft": true,
+}
+
+// titleWords returns the distinct words in the nameKey of title, ignoring
+// punctuation, and leaving out articles and commonTitleWords unless the title
+// is nothing but common words.
+func titleWords(title string) []string {
+	var words, common []string
+	seen := map[string]bool{}
+	for _, word := range strings.FieldsFunc(nameKey(title), isWordSeparator) {
+		if seen[word] || isArticle(word) {
+			continue
+		}
+		seen[word] = true
+		if commonTitleWords[word] {
+			common = append(common, word)
+		} else {
+			words = append(words, word)
+		}
+	}
+	if len(words) == 0 {
+		return common
+	}
+	return words
+}
+
+func isWordSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '\''
+}
+
+// resolvePlaylistTrack finds the entry for a track in the playlist pls. The
+// path may be absolute, relative to the playlist, or from another machine or
+// mount point. If the file can't be found, the track is matched by its
+// identifier, or failing that by its metadata. It must be called with
+// fs.lock held.
+func (fs *FS) resolvePlaylistTrack(pls FileInfo, track playlistTrack) (*FileEntry, *PlaylistMatch) {
+	if track.file != "" {
+		path := filepath.FromSlash(track.file)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(pls.FullPath()), path)
+		}
+		if entry := fs.entries[filepath.Clean(path)]; entry != nil {
+			return entry, &PlaylistMatch{By: MatchPath, Confidence: 1}
+		}
+	}
+
+	for _, id := range parseMusicBrainzIDs(track.info.Identifier) {
+		// The same recording may be on more than one release, so the
+		// metadata picks between them:
+		var best *FileEntry
+		var bestScore float64
+		for _, key := range sortedKeys(fs.audioRefs["mbid:"+id]) {
+			entry := fs.entries[key]
+			score, _ := fs.metadataScore(track.info, entry.Metadata)
+			if best == nil || score > bestScore {
+				best, bestScore = entry, score
+			}
+		}
+		if best != nil {
+			return best, &PlaylistMatch{By: MatchIdentifier, Confidence: 1}
+		}
+	}
+
+	entry, match := fs.matchSuffix(track.file)
+	if other, otherMatch := fs.matchMetadata(track.info); other != nil && (entry == nil || otherMatch.Confidence > match.Confidence) {
+		entry, match = other, otherMatch
+	}
+	return entry, match
+}
+
+// matchSuffix finds the entry whose path shares the most trailing parts with
+// file, as long as there is only one. Each part that matches halves the doubt
+// about the match, so the name alone has a confidence of 0.5.
+func (fs *FS) matchSuffix(file string) (*FileEntry, *PlaylistMatch) {
+	if file == "" {
+		return nil, nil
+	}
+	parts := strings.Split(filepath.ToSlash(file), "/")
+	var best *FileEntry
+	bestCount, tie := 0, false
+	for key := range fs.audioRefs["file:"+strings.ToLower(parts[len(parts)-1])] {
+		keyParts := strings.Split(filepath.ToSlash(key), "/")
+		count := 0
+		for count < len(parts) && count < len(keyParts) &&
+			strings.EqualFold(parts[len(parts)-1-count], keyParts[len(keyParts)-1-count]) {
+			count++
+		}
+		if count > bestCount {
+			best, bestCount, tie = fs.entries[key], count, false
+		} else if count == bestCount {
+			tie = true
+		}
+	}
+	if best == nil || tie {
+		return nil, nil
+	}
+	doubt := 1.0
+	for i := 0; i < bestCount; i++ {
+		doubt /= 2
+	}
+	return best, &PlaylistMatch{By: MatchSuffix, Confidence: 1 - doubt}
+}
+
+// matchMetadata finds the entry that best matches info, out of those that
+// share a word of the title, as long as it is confident enough and there's
+// no other match nearly as good.
+func (fs *FS) matchMetadata(info playlist.TrackInfo) (*FileEntry, *PlaylistMatch) {
+	candidates := map[string]bool{}
+	for _, word := range titleWords(info.Title) {
+		for key := range fs.audioRefs["word:"+word] {
+			candidates[key] = true
+		}
+	}
+
+	var best *FileEntry
+	var bestScore, secondScore float64
+	for _, key := range sortedKeys(candidates) {
+		entry := fs.entries[key]
+		score, ok := fs.metadataScore(info, entry.Metadata)
+		if !ok {
+			continue
+		}
+		if score > bestScore {
+			best, bestScore, secondScore = entry, score, bestScore
+		} else if score > secondScore {
+			secondScore = score
+		}
+	}
+	if best == nil || bestScore < minMatchConfidence || bestScore-secondScore < ambiguousMatch {
+		return nil, nil
+	}
+	return best, &PlaylistMatch{By: MatchMetadata, Confidence: bestScore}
+}
+
+// metadataScore returns how well meta matches info, from 0 to 1, weighting
+// each thing info knows about the track. ok is false if the titles aren't
+// similar, the durations are too far apart, or info only knows the title.
+func (fs *FS) metadataScore(info playlist.TrackInfo, meta *Metadata) (score float64, ok bool) {
+	if meta == nil || info.Title == "" || meta.Title == "" {
+		return 0, false
+	}
+	title := similarity(nameKey(info.Title), nameKey(meta.Title))
+	if title < minTitleSimilarity {
+		return 0, false
+	}
+
+	total, weight := 4*title, 4.0
+	if info.Artist != "" {
+		artist := nameKey(info.Artist)
+		best := 0.0
+		for _, name := range append(meta.ArtistValues(fs.delimiters), meta.Artist, meta.AlbumArtist) {
+			if sim := similarity(artist, nameKey(name)); sim > best {
+				best = sim
+			}
+		}
+		total, weight = total+3*best, weight+3
+	}
+	if info.Album != "" {
+		total, weight = total+2*similarity(nameKey(info.Album), nameKey(meta.Album)), weight+2
+	}
+	if info.TrackNum > 0 {
+		if info.TrackNum == meta.Track {
+			total++
+		}
+		weight++
+	}
+	if info.Duration > 0 && meta.Duration > 0 {
+		diff := info.Duration - meta.Duration
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > maxDurationDiff {
+			return 0, false
+		}
+		match := 1.0
+		if diff > durationTolerance {
+			match = 1 - float64(diff-durationTolerance)/float64(maxDurationDiff-durationTolerance)
+		}
+		total, weight = total+2*match, weight+2
+	}
+
+	if weight == 4 {
+		return 0, false
+	}
+	return total / weight, true
+}
+
+// similarity returns 1 minus the edit distance between a and b, relative to
+// the length of the longer of them.
+func similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	ar, br := []rune(a), []rune(b)
+	longest := len(ar)
+	if len(br) > longest {
+		longest = len(br)
+	}
+	return 1 - float64(levenshtein(ar, br))/float64(longest)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,149 @@
+package musefuse
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shabbyrobe/musefuse/playlist"
+)
+
+func TestSimilarity(t *testing.T) {
+	for idx, tc := range []struct {
+		a, b string
+		out  float64
+	}{
+		{"so what", "so what", 1},
+		{"abcd", "abce", 0.75},
+		{"", "abc", 0},
+		{"kitten", "sitting", 1 - 3.0/7},
+	} {
+		if out := similarity(tc.a, tc.b); out != tc.out {
+			t.Fatal(idx, out)
+		}
+	}
+}
+
+func TestTitleWords(t *testing.T) {
+	for idx, tc := range []struct {
+		title string
+		words []string
+	}{
+		{"The Girl from Ipanema", []string{"girl", "from", "ipanema"}},
+		{"I Love You (Live)", []string{"i", "love", "you", "live"}},
+		{"Love Me Tender", []string{"tender"}},
+		{"Love You, Love You", []string{"love", "you"}},
+	} {
+		if words := titleWords(tc.title); !reflect.DeepEqual(words, tc.words) {
+			t.Fatalf("%d %q", idx, words)
+		}
+	}
+}
+
+func TestFSMetadataScore(t *testing.T) {
+	fs := NewFS()
+	meta := &Metadata{Title: "So What", Artist: "Miles Davis", Album: "Kind of Blue", Track: 1, Duration: 545 * time.Second}
+
+	if _, ok := fs.metadataScore(playlist.TrackInfo{Title: "So What"}, meta); ok {
+		t.Fatal("expected title alone not to be enough")
+	}
+	if _, ok := fs.metadataScore(playlist.TrackInfo{Title: "So What", Artist: "Miles Davis", Duration: 600 * time.Second}, meta); ok {
+		t.Fatal("expected duration to rule out match")
+	}
+	if score, _ := fs.metadataScore(playlist.TrackInfo{Title: "so what", Artist: "Davis, Miles", Duration: 547 * time.Second}, meta); score >= minMatchConfidence {
+		t.Fatal("unexpected score", score)
+	}
+	if score, _ := fs.metadataScore(playlist.TrackInfo{Title: "so what", Artist: "MILES DAVIS", Album: "Kind of Blue", TrackNum: 1, Duration: 547 * time.Second}, meta); score != 1 {
+		t.Fatal("unexpected score", score)
+	}
+}
+
+func TestFSPlaylistFuzzy(t *testing.T) {
+	const recording = "c6d1d7a9-8e52-4d0c-94ba-eba44b0e1de0"
+
+	tmp, err := ioutil.TempDir("", "musefuse-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	xspf := `<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/">
+  <trackList>
+    <track>
+      <location>file:///old/Miles%20Davis/01%20So%20What.flac</location>
+      <identifier>https://musicbrainz.org/recording/` + recording + `</identifier>
+      <title>So What</title>
+    </track>
+    <track>
+      <location>file:///old/Miles%20Davis/02%20Freddie%20Freeloader.flac</location>
+      <title>Freddie Freloader</title>
+      <creator>Miles Davis</creator>
+      <album>Kind of Blue</album>
+      <trackNum>2</trackNum>
+      <duration>586000</duration>
+    </track>
+    <track>
+      <title>Blue in Green</title>
+      <creator>Someone Else</creator>
+    </track>
+  </trackList>
+</playlist>`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "mix.xspf"), []byte(xspf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewFS()
+	for _, e := range []*FileEntry{
+		testEntry("Miles Davis/Kind of Blue/1-01 So What.flac", &Metadata{
+			Title: "So What", Artist: "Miles Davis", MusicBrainz: MusicBrainzIDs{Recording: recording},
+		}),
+		testEntry("Miles Davis/Kind of Blue/1-02 Freddie Freeloader.flac", &Metadata{
+			Title: "Freddie Freeloader", Artist: "Miles Davis", Album: "Kind of Blue", Track: 2, Duration: 589 * time.Second,
+		}),
+		testEntry("Bill Evans/Blue in Green.flac", &Metadata{Title: "Blue in Green", Artist: "Bill Evans"}),
+	} {
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.AddPlaylist(FileInfo{Prefix: tmp, Path: "mix.xspf", Kind: FilePlaylist}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, ok := fs.lookup("playlists/mix/001 Miles Davis - So What.flac").(*fileNode)
+	if !ok || first.match.By != MatchIdentifier || first.match.Confidence != 1 {
+		t.Fatal("expected match by identifier")
+	}
+	second, ok := fs.lookup("playlists/mix/002 Miles Davis - Freddie Freeloader.flac").(*fileNode)
+	if !ok || second.match.By != MatchMetadata || second.match.Confidence < minMatchConfidence {
+		t.Fatal("expected match by metadata")
+	}
+	if fs.lookup("playlists/mix/003 Bill Evans - Blue in Green.flac") != nil {
+		t.Fatal("unexpected match for another artist")
+	}
+	text, ok := fs.lookup("playlists/mix" + UnresolvedSuffix).(*textNode)
+	if !ok || string(text.data) != "003 Someone Else - Blue in Green\n" {
+		t.Fatal("expected unresolved track")
+	}
+
+	rec := httptest.NewRecorder()
+	path := "/playlists/mix/" + url.PathEscape("002 Miles Davis - Freddie Freeloader.flac")
+	(&indexHandler{fs: fs}).ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	var rs struct {
+		Metadata *Metadata
+		Match    *PlaylistMatch
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &rs); err != nil {
+		t.Fatal(err, rec.Body.String())
+	}
+	if rs.Match == nil || *rs.Match != *second.match || rs.Metadata.Title != "Freddie Freeloader" {
+		t.Fatal("unexpected response", rec.Body.String())
+	}
+}
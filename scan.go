@@ -0,0 +1,203 @@
+package musefuse
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scanner loads FileEntries for many files at once using a bounded pool of
+// workers. Tag parsing is mostly waiting on the disk, so there's a lot to be
+// gained from keeping more than one read in flight.
+type Scanner struct {
+	// Workers is the number of files to load concurrently. If <= 0,
+	// runtime.NumCPU() is used.
+	Workers int
+
+	Load     EntryLoader
+	Progress *ScanProgress
+}
+
+func NewScanner(load EntryLoader) *Scanner {
+	return &Scanner{
+		Load:     load,
+		Progress: &ScanProgress{},
+	}
+}
+
+// errScanStopped stops the walk in ScanLister once fn has failed.
+var errScanStopped = errors.New("musefuse: scan stopped")
+
+// ScanLister walks lister and loads each FileAudio as soon as the walk finds
+// it, so tag parsing can get underway before the walk is finished. Each entry
+// is passed to fn as soon as it is loaded, so the FS fills up while the rest
+// of the library is still being scanned, and no more than a few entries are
+// held at once. fn is called from a single goroutine, in no particular order.
+// An FS builds the same tree whatever order its entries are added in: file
+// names, album directories and covers are chosen by sorting the entries, not
+// by when they arrived. The only exception is the rare inode hash collision;
+// see FS.inode. If fn returns an error, the scan stops and ScanLister returns
+// it.
+//
+// Every file found by the walk is returned, sorted as per Lister.List.
+func (sc *Scanner) ScanLister(lister *Lister, fn func(entry *FileEntry) error) (files []FileInfo, err error) {
+	workers := sc.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	progress := sc.Progress
+	if progress == nil {
+		progress = &ScanProgress{}
+	}
+	progress.begin(0)
+
+	jobs := make(chan FileInfo, workers*4)
+	results := make(chan *FileEntry, workers)
+	stop := make(chan struct{})
+
+	walkErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		walkErr <- lister.Walk(func(info FileInfo) error {
+			files = append(files, info)
+			if info.Kind != FileAudio {
+				return nil
+			}
+			atomic.AddInt64(&progress.total, 1)
+			select {
+			case jobs <- info:
+				return nil
+			case <-stop:
+				return errScanStopped
+			}
+		})
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				entry := sc.Load(file)
+				progress.done(entry)
+				select {
+				case results <- entry:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for entry := range results {
+		if err != nil {
+			// Drain so the workers can exit:
+			continue
+		}
+		if err = fn(entry); err != nil {
+			close(stop)
+		}
+	}
+	if werr := <-walkErr; err == nil && werr != nil {
+		err = werr
+	}
+	progress.end()
+	if err != nil {
+		return nil, err
+	}
+
+	sortFiles(files)
+	return files, nil
+}
+
+// ScanProgress reports how far through a scan we are. It is safe to read from
+// other goroutines while the scan is running.
+type ScanProgress struct {
+	total  int64
+	loaded int64
+	errors int64
+
+	lock   sync.Mutex
+	start  time.Time
+	finish time.Time
+}
+
+// ScanStats is a point-in-time snapshot of a ScanProgress.
+type ScanStats struct {
+	Total       int64
+	Loaded      int64
+	Errors      int64
+	Elapsed     time.Duration
+	FilesPerSec float64
+	ETA         time.Duration
+	Done        bool
+}
+
+func (sp *ScanProgress) begin(total int) {
+	atomic.StoreInt64(&sp.total, int64(total))
+	atomic.StoreInt64(&sp.loaded, 0)
+	atomic.StoreInt64(&sp.errors, 0)
+
+	sp.lock.Lock()
+	sp.start = time.Now()
+	sp.finish = time.Time{}
+	sp.lock.Unlock()
+}
+
+func (sp *ScanProgress) done(entry *FileEntry) {
+	atomic.AddInt64(&sp.loaded, 1)
+	if entry.Err != "" {
+		atomic.AddInt64(&sp.errors, 1)
+	}
+}
+
+func (sp *ScanProgress) end() {
+	sp.lock.Lock()
+	sp.finish = time.Now()
+	sp.lock.Unlock()
+}
+
+func (sp *ScanProgress) Stats() ScanStats {
+	sp.lock.Lock()
+	start, end := sp.start, sp.finish
+	sp.lock.Unlock()
+
+	stats := ScanStats{
+		Total:  atomic.LoadInt64(&sp.total),
+		Loaded: atomic.LoadInt64(&sp.loaded),
+		Errors: atomic.LoadInt64(&sp.errors),
+		Done:   !end.IsZero(),
+	}
+	if start.IsZero() {
+		return stats
+	}
+
+	if stats.Done {
+		stats.Elapsed = end.Sub(start)
+	} else {
+		stats.Elapsed = time.Since(start)
+	}
+
+	if secs := stats.Elapsed.Seconds(); secs > 0 {
+		stats.FilesPerSec = float64(stats.Loaded) / secs
+	}
+	if stats.FilesPerSec > 0 && !stats.Done {
+		remaining := float64(stats.Total - stats.Loaded)
+		stats.ETA = time.Duration(remaining / stats.FilesPerSec * float64(time.Second))
+	}
+	return stats
+}
+
+func (stats ScanStats) String() string {
+	return fmt.Sprintf("scanned %d/%d files (%.1f files/sec, %d errors, ETA %s)",
+		stats.Loaded, stats.Total, stats.FilesPerSec, stats.Errors, stats.ETA.Round(time.Second))
+}
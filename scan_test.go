@@ -0,0 +1,106 @@
+package musefuse
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func testScanDir(t *testing.T, n int) (dir string, lister *Lister) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "musefuse-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%d", i%7), fmt.Sprintf("%03d.mp3", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "mix.m3u"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir, NewLister([]string{dir}, AudioExtensions, PlaylistExtensions)
+}
+
+func TestScannerStreams(t *testing.T) {
+	dir, lister := testScanDir(t, 100)
+	defer os.RemoveAll(dir)
+
+	// One file can't finish loading until every other one has reached fn:
+	release := make(chan struct{})
+	blocked := false
+	sc := NewScanner(func(file FileInfo) *FileEntry {
+		if filepath.Base(file.Path) == "042.mp3" {
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+				blocked = true
+			}
+		}
+		return &FileEntry{File: file}
+	})
+	sc.Workers = 4
+
+	seen := map[string]bool{}
+	files, err := sc.ScanLister(lister, func(entry *FileEntry) error {
+		if seen[entry.File.Path] {
+			return fmt.Errorf("%s seen twice", entry.File.Path)
+		}
+		seen[entry.File.Path] = true
+		if len(seen) == 99 {
+			close(release)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocked {
+		t.Fatal("entries were not passed to fn until every file was loaded")
+	}
+	if len(seen) != 100 || len(files) != 101 {
+		t.Fatal(len(seen), len(files))
+	}
+	if !sort.SliceIsSorted(files, func(i, j int) bool { return fileLess(files[i], files[j]) }) {
+		t.Fatal("files not sorted")
+	}
+
+	stats := sc.Progress.Stats()
+	if !stats.Done || stats.Loaded != 100 || stats.Total != 100 {
+		t.Fatal(stats)
+	}
+}
+
+func TestScannerStopsOnError(t *testing.T) {
+	dir, lister := testScanDir(t, 500)
+	defer os.RemoveAll(dir)
+
+	sc := NewScanner(func(file FileInfo) *FileEntry { return &FileEntry{File: file} })
+	sc.Workers = 4
+
+	fail := errors.New("fail")
+	var calls int
+	_, err := sc.ScanLister(lister, func(entry *FileEntry) error {
+		calls++
+		if calls == 10 {
+			return fail
+		}
+		return nil
+	})
+	if err != fail || calls != 10 {
+		t.Fatal(err, calls)
+	}
+	if !sc.Progress.Stats().Done {
+		t.Fatal("expected stopped scan to be done")
+	}
+}
@@ -0,0 +1,140 @@
+package musefuse
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// AddSidecar adds, or replaces, a FileSidecar. It is shown in every directory
+// of a View with Sidecars set that contains an audio file from the same
+// source directory.
+func (fs *FS) AddSidecar(file FileInfo) {
+	fs.lock.Lock()
+	key := file.FullPath()
+	srcDir := filepath.Dir(key)
+	if fs.sidecars[srcDir] == nil {
+		fs.sidecars[srcDir] = map[string]FileInfo{}
+	}
+	fs.sidecars[srcDir][key] = file
+	fs.updateSidecarsFrom(srcDir)
+	pending := fs.takePending()
+	fs.lock.Unlock()
+
+	fs.invalidate(pending)
+}
+
+// RemoveSidecar removes the FileSidecar at the full path key. It returns false
+// if there was no such sidecar.
+func (fs *FS) RemoveSidecar(key string) bool {
+	fs.lock.Lock()
+	srcDir := filepath.Dir(key)
+	_, ok := fs.sidecars[srcDir][key]
+	if ok {
+		delete(fs.sidecars[srcDir], key)
+		if len(fs.sidecars[srcDir]) == 0 {
+			delete(fs.sidecars, srcDir)
+		}
+		fs.updateSidecarsFrom(srcDir)
+	}
+	pending := fs.takePending()
+	fs.lock.Unlock()
+
+	fs.invalidate(pending)
+	return ok
+}
+
+// updateSidecarsFrom updates every directory showing files from srcDir. It
+// must be called with fs.lock held.
+func (fs *FS) updateSidecarsFrom(srcDir string) {
+	seen := map[*dirNode]bool{}
+	for key := range fs.sourceDirs[srcDir] {
+		for _, file := range fs.nodes[key] {
+			dir := file.parent
+			if dir != nil && dir.showSidecars && !seen[dir] {
+				seen[dir] = true
+				fs.updateSidecars(dir)
+			}
+		}
+	}
+}
+
+// updateSidecars replaces the sidecars shown in dir with the ones from the
+// source directories of dir's files. It must be called with fs.lock held.
+func (fs *FS) updateSidecars(dir *dirNode) {
+	type want struct {
+		name string
+		file *fileNode // The file the sidecar was found with
+		info FileInfo
+	}
+
+	var wants []want
+	seen := map[string]bool{}
+	for _, file := range dir.files {
+		srcDir := filepath.Dir(file.entry.File.FullPath())
+		if seen[srcDir] {
+			continue
+		}
+		seen[srcDir] = true
+
+		for _, info := range fs.sidecars[srcDir] {
+			name := filepath.Base(info.Path)
+			if strings.EqualFold(filepath.Ext(name), ".lrc") {
+				// Lyrics have to have the same name as the track for players to
+				// find them:
+				for _, track := range dir.files {
+					if trimExt(track.entry.File.FullPath(), "") == trimExt(info.FullPath(), "") {
+						name = trimExt(track.name, "") + filepath.Ext(name)
+						break
+					}
+				}
+			}
+			wants = append(wants, want{name: name, file: file, info: info})
+		}
+	}
+	sort.Slice(wants, func(i, j int) bool {
+		return fileLess(wants[i].info, wants[j].info)
+	})
+
+	// Work out the final names before touching anything, so nothing needs to
+	// change if they are the same as before:
+	current := make(map[string]bool, len(dir.sidecars))
+	for _, file := range dir.sidecars {
+		current[file.name] = true
+	}
+	chosen := map[string]bool{}
+	same := len(wants) == len(dir.sidecars)
+	for i := range wants {
+		w := &wants[i]
+		ext := filepath.Ext(w.name)
+		base := sanitisePart.ReplaceAllString(trimExt(w.name, ""), "_")
+		w.name = base + ext
+		for ver := 2; ; ver++ {
+			if _, ok := dir.index[w.name]; (!ok || current[w.name]) && !chosen[w.name] {
+				break
+			}
+			w.name = fmt.Sprintf("%s v%d%s", base, ver, ext)
+		}
+		chosen[w.name] = true
+
+		if same && (dir.sidecars[i].name != w.name || dir.sidecars[i].entry.File != w.info) {
+			same = false
+		}
+	}
+	if same {
+		return
+	}
+
+	for _, file := range dir.sidecars {
+		fs.pending = append(fs.pending, invalidation{dir, file.name})
+	}
+	dir.removeSidecars()
+
+	for _, w := range wants {
+		file := newFileNode(fs.handles, fs.inode(dir.childPath(w.name), &w.info), w.name, &FileEntry{File: w.info})
+		file.symlink = w.file.symlink
+		dir.addSidecar(file)
+		fs.pending = append(fs.pending, invalidation{dir, w.name})
+	}
+}
@@ -0,0 +1,53 @@
+package musefuse
+
+import (
+	"testing"
+)
+
+func TestFSSidecars(t *testing.T) {
+	fs := NewFS()
+	track := testEntry("album/01 so what.flac", &Metadata{Artist: "Foo", Album: "X", Title: "So What", Track: 1})
+	other := testEntry("elsewhere/a.flac", &Metadata{Artist: "Foo", Album: "Y", Title: "A"})
+	for _, e := range []*FileEntry{track, other} {
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lrc := FileInfo{Prefix: "/music", Path: "album/01 so what.lrc", Kind: FileSidecar}
+	cue := FileInfo{Prefix: "/music", Path: "album/rip.cue", Kind: FileSidecar}
+	fs.AddSidecar(lrc)
+	fs.AddSidecar(cue)
+
+	for _, name := range []string{"01 So What.lrc", "rip.cue"} {
+		if _, ok := fs.lookup("artistalbum/Foo/X/" + name).(*fileNode); !ok {
+			t.Fatal("expected sidecar", name)
+		}
+	}
+	if fs.lookup("artistalbum/Foo/Y/rip.cue") != nil {
+		t.Fatal("unexpected sidecar in album from another directory")
+	}
+	if fs.lookup("artist/Foo/rip.cue") != nil {
+		t.Fatal("unexpected sidecar in view without Sidecars")
+	}
+
+	if !fs.RemoveSidecar(cue.FullPath()) {
+		t.Fatal("expected removal")
+	}
+	if fs.lookup("artistalbum/Foo/X/rip.cue") != nil {
+		t.Fatal("expected sidecar to be removed")
+	}
+
+	fs.RemoveAudio(track.File.FullPath())
+	if fs.lookup("artistalbum/Foo/X") != nil {
+		t.Fatal("expected album dir to be pruned")
+	}
+
+	// Adding the track back brings back the sidecar:
+	if err := fs.AddAudio(track); err != nil {
+		t.Fatal(err)
+	}
+	if fs.lookup("artistalbum/Foo/X/01 So What.lrc") == nil {
+		t.Fatal("expected sidecar to return with its track")
+	}
+}
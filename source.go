@@ -0,0 +1,89 @@
+package musefuse
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// defaultDatabase is used in ViewSource for files from a Lister created
+// without database names.
+const defaultDatabase = "default"
+
+// SetDatabasePaths tells the FS which paths the named database searches. If
+// there are more than one, each gets its own directory in ViewSource, named
+// for the last element of the path, so the same relative path under two of
+// them doesn't collide. It only affects files added after it is called.
+func (fs *FS) SetDatabasePaths(database string, paths []string) {
+	roots := map[string]string{}
+	if len(paths) > 1 {
+		abs := make([]string, len(paths))
+		names := map[string]int{}
+		for i, path := range paths {
+			abs[i] = filepath.Clean(path)
+			if full, err := filepath.Abs(path); err == nil {
+				abs[i] = full
+			}
+			names[filepath.Base(abs[i])]++
+		}
+		for _, path := range abs {
+			name := filepath.Base(path)
+			if names[name] > 1 {
+				name = fmt.Sprintf("%s [%s]", name, pathHash(FileInfo{Prefix: path}))
+			}
+			roots[path] = name
+		}
+	}
+
+	fs.lock.Lock()
+	fs.dbRoots[database] = roots
+	fs.lock.Unlock()
+}
+
+// replaceSourceFile replaces the ViewSource node for a file that isn't audio.
+// It must be called with fs.lock held.
+func (fs *FS) replaceSourceFile(file FileInfo) error {
+	key := file.FullPath()
+	nodes := fs.nodes[key]
+	delete(fs.nodes, key)
+	fs.removeNodes(nodes)
+
+	entry := &FileEntry{File: file}
+	if !fs.hasView(entry, ViewSource) {
+		return nil
+	}
+	return fs.addMirrorNode(ViewSource, entry)
+}
+
+// addMirrorNode adds entry to view, which mirrors the source directories like
+// ViewSource does, at the same path relative to the database (or the
+// directory for its Prefix, if the database has more than one path) as the
+// source file is relative to its Prefix. It must be called with fs.lock held.
+func (fs *FS) addMirrorNode(view string, entry *FileEntry) error {
+	db := entry.File.Database
+	path := []string{view, db}
+	if db == "" {
+		path[1] = defaultDatabase
+	}
+	if root, ok := fs.dbRoots[db][filepath.Clean(entry.File.Prefix)]; ok {
+		path = append(path, root)
+	}
+
+	parts := strings.Split(filepath.ToSlash(entry.File.Path), "/")
+	last := len(parts) - 1
+	path = append(path, parts[:last]...)
+
+	file, err := fs.addNode(view, trimExt(parts[last], ""), entry, path...)
+	if err != nil {
+		return err
+	}
+
+	// Tell each directory, up to and including the database's or the
+	// Prefix's, where it came from; see dirNode.Getxattr:
+	dir, srcDir := file.parent, filepath.Dir(entry.File.FullPath())
+	for i := last; i >= 0; i-- {
+		dir.setSource(srcDir)
+		dir, srcDir = dir.parent, filepath.Dir(srcDir)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package musefuse
+
+import (
+	"context"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestFSSourceView(t *testing.T) {
+	fs := NewFS()
+	ok := testEntry("Foo/X/01 a.mp3", &Metadata{Artist: "Foo", Title: "A", Album: "X"})
+	bad := testEntry("Foo/X/broken.mp3", nil)
+	bad.Err = "nope"
+	for _, e := range []*FileEntry{ok, bad} {
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	playlist := FileInfo{Prefix: "/music", Path: "mix.m3u", Kind: FilePlaylist}
+	// It can't be loaded, but still shows up:
+	if err := fs.AddPlaylist(playlist); err == nil {
+		t.Fatal("expected error loading playlist")
+	}
+
+	for _, path := range []string{"source/default/Foo/X/01 a.mp3", "source/default/Foo/X/broken.mp3", "source/default/mix.m3u"} {
+		if _, ok := fs.lookup(path).(*fileNode); !ok {
+			t.Fatal("expected file", path)
+		}
+	}
+
+	dir, _ := fs.lookup("source/default/Foo").(*dirNode)
+	if dir == nil {
+		t.Fatal("expected dir")
+	}
+	var resp fuse.GetxattrResponse
+	req := &fuse.GetxattrRequest{Name: XattrPrefix + "source_path"}
+	if err := dir.Getxattr(context.Background(), req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Xattr) != "/music/Foo" {
+		t.Fatal("unexpected source_path", string(resp.Xattr))
+	}
+
+	if !fs.RemovePlaylist(playlist.FullPath()) {
+		t.Fatal("expected removal")
+	}
+	fs.RemoveAudio(ok.File.FullPath())
+	fs.RemoveAudio(bad.File.FullPath())
+	if fs.lookup(ViewSource) != nil {
+		t.Fatal("expected source view to be pruned")
+	}
+}
+
+func TestFSSourceViewRoots(t *testing.T) {
+	fs := NewFS()
+	fs.SetDatabasePaths("default", []string{"/a/music", "/b/music", "/c/other"})
+	for _, prefix := range []string{"/a/music", "/b/music", "/c/other"} {
+		e := testEntry("Foo/01 a.mp3", &Metadata{Artist: "Foo", Title: "A"})
+		e.File.Prefix, e.File.Database = prefix, "default"
+		if err := fs.AddAudio(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, dir := range []string{"music [" + pathHash(FileInfo{Prefix: "/a/music"}) + "]", "music [" + pathHash(FileInfo{Prefix: "/b/music"}) + "]", "other"} {
+		if _, ok := fs.lookup("source/default/" + dir + "/Foo/01 a.mp3").(*fileNode); !ok {
+			t.Fatal("expected file in", dir)
+		}
+	}
+
+	dir := fs.lookup("source/default/other").(*dirNode)
+	var resp fuse.GetxattrResponse
+	req := &fuse.GetxattrRequest{Name: XattrPrefix + "source_path"}
+	if err := dir.Getxattr(context.Background(), req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Xattr) != "/c/other" {
+		t.Fatal("unexpected source_path", string(resp.Xattr))
+	}
+}
@@ -0,0 +1,421 @@
+package musefuse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// ViewConfig describes a virtual directory hierarchy built from each file's
+// Metadata. Path is a slash-separated text/template; the first segment is
+// usually a literal naming the top-level directory, the last segment is the
+// file name (the source file's extension is appended automatically):
+//
+//	decade/{{decade .Year}}/{{or .AlbumArtist .Artist}}/{{.Album}}/{{track .}} {{.Title}}
+//
+// The template data is a ViewData, so any Metadata field can be used, as can
+// raw tags via {{.Tag "TCOP"}}. Album is the name the track's album is shown
+// with in ViewComplete, which has the start of the MusicBrainz release ID
+// added if other releases share it, and tracks with a release ID get the
+// AlbumArtist of the release's first track, so a release ends up in one
+// directory even if its tags disagree.
+//
+// Each segment is trimmed of surrounding whitespace. If any segment is empty,
+// the file does not appear in the view. Use the "require" function to leave
+// files out of the view when a value is missing, or "default" to supply a
+// fallback:
+//
+//	genre/{{default "Unknown" .Genre}}/{{require .Artist}}/{{require .Title}}
+//
+// The view can't be called, or put files in, one of the top-level directories
+// the FS builds itself, like "query", "source" or "failed".
+//
+// If Cover is set, each directory containing files gets cover art as
+// "cover.jpg" and "folder.jpg" (or .png, etc). The picture embedded in the
+// first file that has one is used, otherwise any "cover.*" or "folder.*" image
+// next to the source files.
+//
+// If Sidecars is set, each directory containing files also gets the sidecar
+// files (see FileSidecar) found next to the source files. Lyrics (".lrc") are
+// renamed to match the track they belong to.
+//
+// Each lists the multi-valued fields, "artist" and "genre", the view is
+// rendered once for each value of; a track by "A; B" then appears under both A
+// and B. Only the directories are rendered for each value; the file name
+// always uses the primary value. See Metadata.ArtistValues.
+type ViewConfig struct {
+	Name     string   `json:"name"`
+	Path     string   `json:"path"`
+	Cover    bool     `json:"cover"`
+	Sidecars bool     `json:"sidecars"`
+	Each     []string `json:"each"`
+}
+
+// DefaultViews are the views you get if you don't ask for anything else. The
+// failed and unsorted views are not template views; they are built from
+// whatever doesn't fit anywhere else.
+var DefaultViews = []ViewConfig{
+	{Name: ViewArtist, Path: `artist/{{require .Artist}}/{{require .Title}}`, Each: []string{"artist"}},
+	{Name: ViewArtistAlbum, Path: `artistalbum/{{require .Artist | or .AlbumArtist}}/{{require .Album}}/{{track .}} {{require .Title}}`, Cover: true, Sidecars: true},
+	{Name: ViewYear, Path: `year/{{require .Year}}/{{require .Artist}}/{{require .Title}}`},
+	{Name: ViewGenre, Path: `genre/{{require .Genre}}/{{require .Artist}}/{{require .Title}}`, Each: []string{"genre", "artist"}},
+	{Name: ViewMusicBrainz, Path: `mbid/{{require .MusicBrainz.Release}}/{{track .}} {{require .Title}}`, Cover: true},
+	{Name: ViewQuality, Path: `quality/{{require (quality .)}}/{{require .Artist | or .AlbumArtist}}/{{require .Album}}/{{track .}} {{require .Title}}`, Cover: true},
+}
+
+// View is a compiled ViewConfig.
+type View struct {
+	Name     string
+	Cover    bool
+	Sidecars bool
+	each     []string
+	segments []*template.Template
+}
+
+// viewEachFields are the fields that can be used in ViewConfig.Each, and how
+// to get and set their values.
+var viewEachFields = map[string]struct {
+	values func(meta *Metadata, delimiters []string) []string
+	set    func(meta *Metadata, value string)
+}{
+	"artist": {(*Metadata).ArtistValues, func(meta *Metadata, v string) { meta.Artist = v }},
+	"genre":  {(*Metadata).GenreValues, func(meta *Metadata, v string) { meta.Genre = v }},
+}
+
+// ViewData is passed to view templates.
+type ViewData struct {
+	*Metadata
+	File FileInfo
+}
+
+// Tag returns the raw tag value called name, or an empty string. Tag names
+// are not standardised between formats, see Metadata.Raw.
+func (vd ViewData) Tag(name string) string {
+	v, ok := vd.Raw[name]
+	if !ok {
+		for k, kv := range vd.Raw {
+			if strings.EqualFold(k, name) {
+				v, ok = kv, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return ""
+	}
+	s, _ := rawTagString(v)
+	return s
+}
+
+var errViewMissing = errors.New("musefuse: required value missing")
+
+var viewFuncs = template.FuncMap{
+	// require returns v, or leaves the file out of the view if v is empty.
+	"require": func(v interface{}) (interface{}, error) {
+		if isEmptyValue(v) {
+			return nil, errViewMissing
+		}
+		return v, nil
+	},
+
+	// default returns v, or def if v is empty.
+	"default": func(def interface{}, v interface{}) interface{} {
+		if isEmptyValue(v) {
+			return def
+		}
+		return v
+	},
+
+	// decade formats a year as "1960s", or returns "" if there is no year.
+	"decade": func(year int) string {
+		if year <= 0 {
+			return ""
+		}
+		return strconv.Itoa(year-year%10) + "s"
+	},
+
+	// track formats the disc and track number as "01" or "01-02". It returns
+	// an empty string if there is no track number.
+	"track": func(vd ViewData) string {
+		return formatTrack(vd.Metadata)
+	},
+
+	// quality returns "lossless", the nearest common bitrate like "320k", or
+	// an empty string if the bitrate isn't known.
+	"quality": func(vd ViewData) string {
+		return formatQuality(vd.Metadata)
+	},
+
+	// pad zero-pads n to width digits.
+	"pad": func(width int, n int) string {
+		return fmt.Sprintf("%0*d", width, n)
+	},
+
+	// initial returns the upper case first letter of s, or "#" if s doesn't
+	// start with a letter.
+	"initial": func(s string) string {
+		for _, r := range s {
+			if !unicode.IsLetter(r) {
+				return "#"
+			}
+			return string(unicode.ToUpper(r))
+		}
+		return ""
+	},
+
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+func formatTrack(meta *Metadata) string {
+	if meta.Disc > 0 && (meta.Discs > 1 || meta.Discs == 0) && meta.Track > 0 {
+		return fmt.Sprintf("%02d-%02d", meta.Disc, meta.Track)
+	} else if meta.Track > 0 {
+		return fmt.Sprintf("%02d", meta.Track)
+	}
+	return ""
+}
+
+// qualityBitrates are the directories in ViewQuality for lossy files, in
+// kbit/s.
+var qualityBitrates = []int{64, 96, 128, 160, 192, 256, 320}
+
+func formatQuality(meta *Metadata) string {
+	if meta.Lossless {
+		return "lossless"
+	}
+	if meta.Bitrate <= 0 {
+		return ""
+	}
+	best := qualityBitrates[0]
+	for _, rate := range qualityBitrates {
+		if abs(meta.Bitrate-rate) < abs(meta.Bitrate-best) {
+			best = rate
+		}
+	}
+	return strconv.Itoa(best) + "k"
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func isEmptyValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return strings.TrimSpace(fmt.Sprint(v)) == "" || rv.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() <= 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+func NewView(config ViewConfig) (*View, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("musefuse: view has no name")
+	}
+	if isReservedDir(config.Name) {
+		return nil, fmt.Errorf("musefuse: view %q can't be redefined", config.Name)
+	}
+
+	parts, err := splitViewPath(config.Path)
+	if err != nil {
+		return nil, fmt.Errorf("musefuse: view %q: %w", config.Name, err)
+	}
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("musefuse: view %q: path %q needs at least a directory and a file name", config.Name, config.Path)
+	}
+	if top := strings.TrimSpace(parts[0]); isReservedDir(top) {
+		return nil, fmt.Errorf("musefuse: view %q: top-level directory %q is reserved", config.Name, top)
+	}
+
+	for _, field := range config.Each {
+		if _, ok := viewEachFields[field]; !ok {
+			return nil, fmt.Errorf("musefuse: view %q: unknown field %q in each, expected 'artist' or 'genre'", config.Name, field)
+		}
+	}
+
+	view := &View{Name: config.Name, Cover: config.Cover, Sidecars: config.Sidecars, each: config.Each}
+	for i, part := range parts {
+		tpl, err := template.New(fmt.Sprintf("%s[%d]", config.Name, i)).
+			Option("missingkey=zero").
+			Funcs(viewFuncs).
+			Parse(part)
+		if err != nil {
+			return nil, fmt.Errorf("musefuse: view %q: %w", config.Name, err)
+		}
+		view.segments = append(view.segments, tpl)
+	}
+	return view, nil
+}
+
+// BuildViews compiles DefaultViews, followed by configs. A config with the
+// same name as one of the DefaultViews replaces it.
+func BuildViews(configs []ViewConfig) ([]*View, error) {
+	var all []ViewConfig
+	replaced := map[string]bool{}
+	for _, config := range configs {
+		replaced[config.Name] = true
+	}
+	for _, def := range DefaultViews {
+		if !replaced[def.Name] {
+			all = append(all, def)
+		}
+	}
+	all = append(all, configs...)
+
+	views := make([]*View, 0, len(all))
+	seen := map[string]bool{}
+	for _, config := range all {
+		if seen[config.Name] {
+			return nil, fmt.Errorf("musefuse: view %q defined more than once", config.Name)
+		}
+		seen[config.Name] = true
+
+		view, err := NewView(config)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// Render returns the directories and file name (without extension) for entry
+// in this view. ok is false if entry does not belong in the view.
+func (view *View) Render(entry *FileEntry) (dirs []string, name string, ok bool) {
+	if entry.Metadata == nil {
+		return nil, "", false
+	}
+	parts, ok := view.render(ViewData{Metadata: entry.Metadata, File: entry.File}, 0)
+	if !ok {
+		return nil, "", false
+	}
+	last := len(parts) - 1
+	return parts[:last], parts[last], true
+}
+
+// RenderEach is like Render, but returns the directories for each value of
+// the fields in ViewConfig.Each, with tags split on delimiters. ok is false if
+// entry does not belong in the view for any of them.
+//
+// If names is not nil, it is called with "artist", "album" or "genre" and
+// each value of those fields, and returns the spelling to use in the view.
+func (view *View) RenderEach(entry *FileEntry, delimiters []string, names func(field, value string) string) (paths [][]string, name string, ok bool) {
+	if entry.Metadata == nil {
+		return nil, "", false
+	}
+	if names == nil {
+		names = func(field, value string) string { return value }
+	}
+
+	base := *entry.Metadata
+	base.Artist = names(nameArtist, base.Artist)
+	base.AlbumArtist = names(nameArtist, base.AlbumArtist)
+	base.Album = names(nameAlbum, base.Album)
+	base.Genre = names(nameGenre, base.Genre)
+
+	dirs, name, ok := view.Render(&FileEntry{File: entry.File, Metadata: &base})
+	if !ok || len(view.each) == 0 {
+		return [][]string{dirs}, name, ok
+	}
+
+	metas := []*Metadata{&base}
+	for _, field := range view.each {
+		each := viewEachFields[field]
+		values := each.values(entry.Metadata, delimiters)
+		if len(values) == 0 {
+			continue
+		}
+		next := make([]*Metadata, 0, len(metas)*len(values))
+		for _, meta := range metas {
+			for _, value := range values {
+				cp := *meta
+				each.set(&cp, names(field, value))
+				next = append(next, &cp)
+			}
+		}
+		metas = next
+	}
+
+	seen := map[string]bool{}
+	for _, meta := range metas {
+		dirs, ok := view.render(ViewData{Metadata: meta, File: entry.File}, 1)
+		key := strings.Join(dirs, "/")
+		if ok && !seen[key] {
+			seen[key] = true
+			paths = append(paths, dirs)
+		}
+	}
+	return paths, name, len(paths) > 0
+}
+
+// render executes every segment but the last skip segments.
+func (view *View) render(data ViewData, skip int) (parts []string, ok bool) {
+	parts = make([]string, len(view.segments)-skip)
+
+	var buf bytes.Buffer
+	for i, tpl := range view.segments[:len(parts)] {
+		buf.Reset()
+		if err := tpl.Execute(&buf, data); err != nil {
+			// Either a require failed or the template is broken for this
+			// data; either way, it doesn't belong here.
+			return nil, false
+		}
+		part := strings.TrimSpace(buf.String())
+		if part == "" || (i == 0 && isReservedDir(part)) {
+			return nil, false
+		}
+		parts[i] = part
+	}
+	return parts, true
+}
+
+// splitViewPath splits a view path template on each '/' that is not inside a
+// template action. Values produced by actions can't add extra directories.
+func splitViewPath(path string) ([]string, error) {
+	var parts []string
+	var depth int
+	var start int
+	for i := 0; i < len(path); i++ {
+		switch {
+		case strings.HasPrefix(path[i:], "{{"):
+			depth++
+			i++
+		case strings.HasPrefix(path[i:], "}}"):
+			if depth == 0 {
+				return nil, fmt.Errorf("unexpected '}}' in path %q", path)
+			}
+			depth--
+			i++
+		case path[i] == '/' && depth == 0:
+			parts = append(parts, path[start:i])
+			start = i + 1
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unclosed '{{' in path %q", path)
+	}
+	parts = append(parts, path[start:])
+
+	for _, part := range parts {
+		if strings.TrimSpace(part) == "" {
+			return nil, fmt.Errorf("empty segment in path %q", path)
+		}
+	}
+	return parts, nil
+}
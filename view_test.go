@@ -0,0 +1,124 @@
+package musefuse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestViewRender(t *testing.T) {
+	views, err := BuildViews([]ViewConfig{
+		{Name: "decade", Path: `decade/{{decade .Year}}/{{or .AlbumArtist .Artist}}/{{.Album}}/{{track .}} {{.Title}}`},
+		{Name: "copyright", Path: `copyright/{{default "Unknown" (.Tag "cprt")}}/{{.Title}}`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]*View{}
+	for _, v := range views {
+		byName[v.Name] = v
+	}
+
+	meta := &Metadata{
+		Artist: "AC/DC", Title: "Thunderstruck", Album: "The Razors Edge",
+		Year: 1990, Track: 1, Raw: map[string]interface{}{"CPRT": "Albert"},
+	}
+	entry := &FileEntry{Metadata: meta}
+
+	for idx, tc := range []struct {
+		view string
+		dirs []string
+		name string
+		ok   bool
+	}{
+		{ViewArtist, []string{"artist", "AC/DC"}, "Thunderstruck", true},
+		{ViewArtistAlbum, []string{"artistalbum", "AC/DC", "The Razors Edge"}, "01 Thunderstruck", true},
+		{ViewYear, []string{"year", "1990", "AC/DC"}, "Thunderstruck", true},
+		{ViewGenre, nil, "", false},
+		{"decade", []string{"decade", "1990s", "AC/DC", "The Razors Edge"}, "01 Thunderstruck", true},
+		{"copyright", []string{"copyright", "Albert"}, "Thunderstruck", true},
+	} {
+		dirs, name, ok := byName[tc.view].Render(entry)
+		if ok != tc.ok || name != tc.name || !reflect.DeepEqual(dirs, tc.dirs) {
+			t.Fatal(idx, dirs, name, ok)
+		}
+	}
+
+	// Missing track number shouldn't leave a leading space:
+	meta.Track = 0
+	if _, name, _ := byName[ViewArtistAlbum].Render(entry); name != "Thunderstruck" {
+		t.Fatalf("%q", name)
+	}
+
+	// Album artist replaces artist, but artist is still required:
+	meta.AlbumArtist = "Various"
+	if dirs, _, _ := byName[ViewArtistAlbum].Render(entry); dirs[1] != "Various" {
+		t.Fatal(dirs)
+	}
+	meta.Artist = ""
+	if _, _, ok := byName[ViewArtistAlbum].Render(entry); ok {
+		t.Fatal("expected artist to be required")
+	}
+}
+
+func TestNewViewErrors(t *testing.T) {
+	for idx, path := range []string{
+		"",
+		"onlyone",
+		"a/{{.Title",
+		"a//b",
+		"a/{{nope .Title}}",
+	} {
+		if _, err := NewView(ViewConfig{Name: "x", Path: path}); err == nil {
+			t.Fatal(idx, "expected error for", path)
+		}
+	}
+}
+
+func TestViewRenderEach(t *testing.T) {
+	view, err := NewView(ViewConfig{
+		Name: "genre", Path: `genre/{{require .Genre}}/{{require .Artist}}/{{.Artist}} - {{.Title}}`,
+		Each: []string{"genre", "artist"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := &Metadata{Artist: "A feat. B", Genres: []string{"Jazz", "Funk"}, Genre: "Jazz", Title: "T"}
+	paths, name, ok := view.RenderEach(&FileEntry{Metadata: meta}, DefaultTagDelimiters, nil)
+	if !ok || name != "A feat. B - T" {
+		t.Fatal(name, ok)
+	}
+	expected := [][]string{
+		{"genre", "Jazz", "A"}, {"genre", "Jazz", "B"},
+		{"genre", "Funk", "A"}, {"genre", "Funk", "B"},
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatal(paths)
+	}
+
+	if _, err := NewView(ViewConfig{Name: "x", Path: "a/b", Each: []string{"album"}}); err == nil {
+		t.Fatal("expected error for unknown each field")
+	}
+}
+
+func TestBuildViewsReserved(t *testing.T) {
+	for idx, config := range []ViewConfig{
+		{Name: "query", Path: `q/{{.Title}}`},
+		{Name: "failed", Path: `f/{{.Title}}`},
+		{Name: "mine", Path: `playlists/{{.Title}}`},
+		{Name: "mine", Path: ` complete /{{.Title}}`},
+	} {
+		if _, err := BuildViews([]ViewConfig{config}); err == nil {
+			t.Fatal(idx, "expected error for reserved directory")
+		}
+	}
+
+	views, err := BuildViews([]ViewConfig{{Name: "mine", Path: `{{.Genre}}/{{.Title}}`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &FileEntry{Metadata: &Metadata{Genre: "query", Title: "T"}}
+	if _, _, ok := views[len(views)-1].Render(entry); ok {
+		t.Fatal("expected file to be left out of a reserved directory")
+	}
+}
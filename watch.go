@@ -0,0 +1,377 @@
+package musefuse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	service "github.com/shabbyrobe/go-service"
+)
+
+var (
+	errWatchLimit        = errors.New("musefuse: out of inotify watches")
+	errNotifyUnsupported = errors.New("musefuse: filesystem notifications not supported on this platform")
+)
+
+type notifyEvent struct {
+	Path string
+
+	// Overflow indicates that events were lost and a full rescan is needed.
+	Overflow bool
+}
+
+type notifier interface {
+	Add(dir string) error
+	Events() <-chan notifyEvent
+	Close() error
+}
+
+// EntryLoader produces the FileEntry for a new or changed file.
+type EntryLoader func(file FileInfo) *FileEntry
+
+// Watcher keeps an FS up to date with the files beneath a Lister's paths while
+// it is mounted. Filesystem notifications are used where available; if they
+// are not, or if we run out of watches, Watcher falls back to periodically
+// diffing the output of Lister.List.
+type Watcher struct {
+	lister *Lister
+	fs     *FS
+	load   EntryLoader
+	known  map[string]FileInfo
+
+	// Index, if set, has entries for removed files discarded and is saved
+	// after each batch of changes.
+	Index *Index
+
+	// PollInterval is how often to rescan everything if notifications are not
+	// available.
+	PollInterval time.Duration
+
+	// Settle is how long to wait after a notification for further changes
+	// before rescanning. Tag editors and copies tend to arrive in bursts, so
+	// the wait starts again with each notification.
+	Settle time.Duration
+
+	notifier notifier
+}
+
+var _ service.Runnable = &Watcher{}
+
+// NewWatcher creates a Watcher for fs. files should be the result of the
+// Lister.List call used to populate fs.
+func NewWatcher(lister *Lister, fs *FS, files []FileInfo, load EntryLoader) *Watcher {
+	known := make(map[string]FileInfo, len(files))
+	for _, file := range files {
+		if watchedKind(file.Kind) {
+			known[file.FullPath()] = file
+		}
+	}
+
+	return &Watcher{
+		lister:       lister,
+		fs:           fs,
+		load:         load,
+		known:        known,
+		PollInterval: 5 * time.Minute,
+		Settle:       2 * time.Second,
+	}
+}
+
+func (w *Watcher) Run(ctx service.Context) error {
+	n, err := newNotifier()
+	if err == nil {
+		w.notifier = n
+		for _, root := range w.lister.Paths() {
+			if root, err = filepath.Abs(root); err != nil {
+				break
+			}
+			if err = w.watchTree(root); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		w.fallback(ctx, err)
+	}
+
+	if err := ctx.Ready(); err != nil {
+		return err
+	}
+
+	// settlec is settle.C while settle is running:
+	settle := time.NewTimer(w.Settle)
+	settle.Stop()
+	var settlec <-chan time.Time
+	dirty := map[string]bool{}
+	full := false
+
+	var poll *time.Ticker
+	defer func() {
+		settle.Stop()
+		if poll != nil {
+			poll.Stop()
+		}
+		if w.notifier != nil {
+			w.notifier.Close()
+		}
+	}()
+
+	for {
+		var events <-chan notifyEvent
+		var pollc <-chan time.Time
+		if w.notifier != nil {
+			events = w.notifier.Events()
+		} else {
+			if poll == nil {
+				poll = time.NewTicker(w.PollInterval)
+			}
+			pollc = poll.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case ev, ok := <-events:
+			if !ok {
+				w.fallback(ctx, fmt.Errorf("musefuse: notifier closed unexpectedly"))
+				full = true
+			} else if ev.Overflow {
+				full = true
+			} else {
+				dirty[ev.Path] = true
+			}
+			if settlec != nil && !settle.Stop() {
+				<-settle.C
+			}
+			settle.Reset(w.Settle)
+			settlec = settle.C
+
+		case <-settlec:
+			settlec = nil
+			if full {
+				w.rescanAll(ctx)
+			} else {
+				for path := range dirty {
+					w.rescanPath(ctx, path)
+				}
+			}
+			full = false
+			dirty = map[string]bool{}
+			w.save(ctx)
+
+		case <-pollc:
+			w.rescanAll(ctx)
+			w.save(ctx)
+		}
+	}
+}
+
+func (w *Watcher) fallback(ctx service.Context, err error) {
+	if w.notifier != nil {
+		w.notifier.Close()
+		w.notifier = nil
+	}
+	ctx.OnError(fmt.Errorf("musefuse: falling back to polling every %s: %w", w.PollInterval, err))
+}
+
+func (w *Watcher) watchTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != root && w.lister.ignoredDir(path) {
+			return filepath.SkipDir
+		}
+		return w.notifier.Add(path)
+	})
+}
+
+func (w *Watcher) rescanAll(ctx service.Context) {
+	files, err := w.lister.List(nil)
+	if err != nil {
+		ctx.OnError(err)
+		return
+	}
+
+	seen := make(map[string]bool, len(files))
+	for _, file := range files {
+		if !watchedKind(file.Kind) {
+			continue
+		}
+		seen[file.FullPath()] = true
+		w.update(ctx, file)
+	}
+
+	for key := range w.known {
+		if !seen[key] {
+			w.remove(key)
+		}
+	}
+
+	// Cover images aren't listed, so anything could have changed:
+	for _, root := range w.lister.Paths() {
+		if root, err := filepath.Abs(root); err == nil {
+			w.fs.UpdateCovers(root)
+		}
+	}
+}
+
+// rescanPath brings everything at or beneath path up to date.
+func (w *Watcher) rescanPath(ctx service.Context, path string) {
+	st, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		w.removeUnder(path, nil)
+		w.updateCovers(path)
+		return
+	} else if err != nil {
+		ctx.OnError(err)
+		return
+	}
+
+	if !st.IsDir() {
+		file, ok, err := w.lister.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			ctx.OnError(err)
+			return
+		}
+		if ok && watchedKind(file.Kind) {
+			w.update(ctx, file)
+		} else {
+			w.remove(path)
+		}
+		if isCoverImage(path) {
+			w.updateCovers(path)
+		}
+		return
+	}
+
+	// A directory was created, or moved in from somewhere else. Anything
+	// inside it needs to be watched and compared, unless the Lister skips it:
+	if w.lister.ignoredDir(path) {
+		return
+	}
+	seen := map[string]bool{}
+	if err := filepath.Walk(path, func(sub string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() {
+			if sub != path && w.lister.ignoredDir(sub) {
+				return filepath.SkipDir
+			}
+			if w.notifier != nil {
+				if err := w.notifier.Add(sub); err != nil {
+					w.fallback(ctx, err)
+				}
+			}
+			return nil
+		}
+
+		file, ok, err := w.lister.Stat(sub)
+		if err != nil {
+			return err
+		}
+		if ok && watchedKind(file.Kind) {
+			seen[file.FullPath()] = true
+			w.update(ctx, file)
+		}
+		return nil
+
+	}); err != nil {
+		ctx.OnError(err)
+	}
+
+	w.removeUnder(path, seen)
+	w.updateCovers(path)
+}
+
+// updateCovers tells the FS to look for cover images again if path is one,
+// or is a directory that may contain some.
+func (w *Watcher) updateCovers(path string) {
+	if isCoverImage(path) {
+		w.fs.UpdateCovers(filepath.Dir(path))
+	} else {
+		w.fs.UpdateCovers(path)
+	}
+}
+
+func (w *Watcher) update(ctx service.Context, file FileInfo) {
+	key := file.FullPath()
+	if old, ok := w.known[key]; ok && old.Size == file.Size && old.ModTime.Equal(file.ModTime) {
+		return
+	}
+
+	if file.Kind == FileSidecar {
+		w.fs.AddSidecar(file)
+	} else if file.Kind == FilePlaylist {
+		if err := w.fs.AddPlaylist(file); err != nil {
+			ctx.OnError(err)
+		}
+	} else {
+		entry := w.load(file)
+		if err := w.fs.UpdateAudio(entry); err != nil {
+			ctx.OnError(err)
+		}
+	}
+	w.known[key] = file
+}
+
+func (w *Watcher) remove(key string) {
+	file, ok := w.known[key]
+	if !ok {
+		return
+	}
+	delete(w.known, key)
+	if file.Kind == FileSidecar {
+		w.fs.RemoveSidecar(key)
+		return
+	}
+	if file.Kind == FilePlaylist {
+		w.fs.RemovePlaylist(key)
+		return
+	}
+	w.fs.RemoveAudio(key)
+	if w.Index != nil {
+		w.Index.Remove(key)
+	}
+}
+
+// removeUnder removes every known file at or beneath path that is not in keep.
+func (w *Watcher) removeUnder(path string, keep map[string]bool) {
+	prefix := path + string(filepath.Separator)
+	for key := range w.known {
+		if keep[key] {
+			continue
+		}
+		if key == path || strings.HasPrefix(key, prefix) {
+			w.remove(key)
+		}
+	}
+}
+
+// watchedKind reports whether files of kind are kept up to date by Watcher.
+func watchedKind(kind FileKind) bool {
+	return kind == FileAudio || kind == FileSidecar || kind == FilePlaylist
+}
+
+func (w *Watcher) save(ctx service.Context) {
+	if w.Index != nil {
+		if err := w.Index.Save(); err != nil {
+			ctx.OnError(err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// +build linux
+
+package musefuse
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_DELETE_SELF |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_MOVE_SELF
+
+type inotifyNotifier struct {
+	file   *os.File
+	events chan notifyEvent
+
+	// closed stops read from blocking on events once nothing is receiving
+	// them any more.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	lock  sync.Mutex
+	watch map[int32]string
+}
+
+func newNotifier() (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &inotifyNotifier{
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan notifyEvent, 1024),
+		closed: make(chan struct{}),
+		watch:  map[int32]string{},
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotifyNotifier) Events() <-chan notifyEvent { return n.events }
+
+func (n *inotifyNotifier) Close() error {
+	n.closeOnce.Do(func() { close(n.closed) })
+	return n.file.Close()
+}
+
+// send passes ev to the reader of events, returning false if the notifier was
+// closed instead.
+func (n *inotifyNotifier) send(ev notifyEvent) bool {
+	select {
+	case n.events <- ev:
+		return true
+	case <-n.closed:
+		return false
+	}
+}
+
+func (n *inotifyNotifier) Add(dir string) error {
+	rc, err := n.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var wd int
+	var werr error
+	if err := rc.Control(func(fd uintptr) {
+		wd, werr = syscall.InotifyAddWatch(int(fd), dir, inotifyMask)
+	}); err != nil {
+		return err
+	}
+	if werr == syscall.ENOSPC {
+		return errWatchLimit
+	} else if werr != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: werr}
+	}
+
+	n.lock.Lock()
+	n.watch[int32(wd)] = dir
+	n.lock.Unlock()
+	return nil
+}
+
+func (n *inotifyNotifier) read() {
+	defer close(n.events)
+
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+	for {
+		sz, err := n.file.Read(buf[:])
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				n.send(notifyEvent{Overflow: true})
+			}
+			return
+		}
+
+		var offset int
+		for offset+syscall.SizeofInotifyEvent <= sz {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(raw.Len)]
+			offset += syscall.SizeofInotifyEvent + int(raw.Len)
+
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				if !n.send(notifyEvent{Overflow: true}) {
+					return
+				}
+				continue
+			}
+
+			n.lock.Lock()
+			dir, ok := n.watch[raw.Wd]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				delete(n.watch, raw.Wd)
+			}
+			n.lock.Unlock()
+			if !ok || raw.Mask&syscall.IN_IGNORED != 0 {
+				continue
+			}
+
+			// The name is NUL-padded to an alignment boundary:
+			name := string(nameBytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+
+			path := dir
+			if name != "" {
+				path = filepath.Join(dir, name)
+			}
+			if !n.send(notifyEvent{Path: path}) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,7 @@
+// +build !linux
+
+package musefuse
+
+func newNotifier() (notifier, error) {
+	return nil, errNotifyUnsupported
+}
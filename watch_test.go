@@ -0,0 +1,153 @@
+package musefuse
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	service "github.com/shabbyrobe/go-service"
+)
+
+// testServiceContext is enough of a service.Context to call the Watcher's
+// rescan methods directly.
+type testServiceContext struct {
+	context.Context
+	errs []error
+}
+
+func (ctx *testServiceContext) Ready() error           { return nil }
+func (ctx *testServiceContext) ShouldHalt() bool       { return false }
+func (ctx *testServiceContext) OnError(err error)      { ctx.errs = append(ctx.errs, err) }
+func (ctx *testServiceContext) Runner() service.Runner { return nil }
+
+func TestWatcherRescan(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "musefuse-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := filepath.Join(tmp, "music")
+	write := func(path, contents string) string {
+		path = filepath.Join(tmp, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("music/Foo/1.mp3", "1")
+
+	lister, err := NewDatabaseLister([]Database{{
+		Name:            "default",
+		Paths:           []string{root},
+		AudioExtensions: AudioExtensions,
+		Ignore:          []string{"skip"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := lister.List(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loads := 0
+	fs := NewFS()
+	w := NewWatcher(lister, fs, files, func(file FileInfo) *FileEntry {
+		loads++
+		return &FileEntry{File: file, Metadata: &Metadata{Artist: "A", Album: "B", Title: filepath.Base(file.Path)}}
+	})
+	ctx := &testServiceContext{Context: context.Background()}
+	for _, file := range files {
+		if err := fs.AddAudio(w.load(file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(present map[string]bool) {
+		t.Helper()
+		if len(ctx.errs) > 0 {
+			t.Fatal(ctx.errs)
+		}
+		for path, ok := range present {
+			_, found := fs.entries[filepath.Join(root, filepath.FromSlash(path))]
+			if found != ok {
+				t.Fatal("unexpected entry", path, found)
+			}
+		}
+		if len(fs.entries) != len(w.known) {
+			t.Fatal("entries and known files differ", len(fs.entries), len(w.known))
+		}
+	}
+	expect(map[string]bool{"Foo/1.mp3": true})
+
+	// Created:
+	w.rescanPath(ctx, write("music/Foo/2.mp3", "2"))
+	expect(map[string]bool{"Foo/1.mp3": true, "Foo/2.mp3": true})
+
+	// Modified, which only loads the file again if it looks different:
+	before := loads
+	w.rescanPath(ctx, filepath.Join(root, "Foo", "2.mp3"))
+	if loads != before {
+		t.Fatal("unchanged file loaded again")
+	}
+	w.rescanPath(ctx, write("music/Foo/2.mp3", "changed"))
+	if loads != before+1 {
+		t.Fatal("changed file not loaded again")
+	}
+
+	// Cover images, which aren't listed, but are looked for again:
+	w.rescanPath(ctx, write("music/Foo/folder.png", "png"))
+	if _, ok := fs.lookup("artistalbum/A/B/cover.png").(*coverNode); !ok {
+		t.Fatal("expected new cover")
+	}
+	w.rescanPath(ctx, write("music/Foo/cover.jpg", "jpg"))
+	if _, ok := fs.lookup("artistalbum/A/B/cover.jpg").(*coverNode); !ok {
+		t.Fatal("expected preferred cover")
+	}
+	for _, name := range []string{"folder.png", "cover.jpg"} {
+		if err := os.Remove(filepath.Join(root, "Foo", name)); err != nil {
+			t.Fatal(err)
+		}
+		w.rescanPath(ctx, filepath.Join(root, "Foo", name))
+	}
+	if len(fs.lookup("artistalbum/A/B").(*dirNode).covers) != 0 {
+		t.Fatal("expected covers to be removed")
+	}
+
+	// Deleted:
+	if err := os.Remove(filepath.Join(root, "Foo", "1.mp3")); err != nil {
+		t.Fatal(err)
+	}
+	w.rescanPath(ctx, filepath.Join(root, "Foo", "1.mp3"))
+	expect(map[string]bool{"Foo/1.mp3": false, "Foo/2.mp3": true})
+
+	// A directory moved in, with an ignored directory inside it:
+	write("elsewhere/Bar/3.mp3", "3")
+	write("elsewhere/Bar/skip/4.mp3", "4")
+	if err := os.Rename(filepath.Join(tmp, "elsewhere", "Bar"), filepath.Join(root, "Bar")); err != nil {
+		t.Fatal(err)
+	}
+	w.rescanPath(ctx, filepath.Join(root, "Bar"))
+	expect(map[string]bool{"Foo/2.mp3": true, "Bar/3.mp3": true, "Bar/skip/4.mp3": false})
+
+	// An ignored directory created directly:
+	w.rescanPath(ctx, filepath.Dir(write("music/Foo/skip/5.mp3", "5")))
+	expect(map[string]bool{"Foo/skip/5.mp3": false})
+
+	// Everything out of sight of the notifier:
+	if err := os.RemoveAll(filepath.Join(root, "Foo")); err != nil {
+		t.Fatal(err)
+	}
+	write("music/Baz/6.mp3", "6")
+	w.rescanAll(ctx)
+	expect(map[string]bool{"Foo/2.mp3": false, "Bar/3.mp3": true, "Baz/6.mp3": true})
+	if fs.lookup("source/default/Foo") != nil {
+		t.Fatal("expected removed directory to be pruned")
+	}
+}
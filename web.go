@@ -53,12 +53,23 @@ func (index *indexHandler) ServeHTTP(rs http.ResponseWriter, rq *http.Request) {
 	}
 
 	if dir, ok := node.(*dirNode); ok {
-		for _, entry := range dir.entries {
+		dir.lock.RLock()
+		source := dir.source
+		dir.lock.RUnlock()
+		if source != "" {
+			rs.Header().Set("X-Musefuse-Source-Path", source)
+		}
+		for _, entry := range dir.dirents() {
 			fmt.Fprintln(rs, entry.Name)
 		}
 
 	} else if file, ok := node.(*fileNode); ok {
-		bts, err := json.MarshalIndent(file.entry, "", "  ")
+		data := struct {
+			*FileEntry
+			Match *PlaylistMatch `json:",omitempty"`
+		}{file.entry, file.match}
+
+		bts, err := json.MarshalIndent(data, "", "  ")
 		if err != nil {
 			http.Error(rs, "data marshal failed", 500)
 			return
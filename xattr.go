@@ -0,0 +1,175 @@
+package musefuse
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/dhowden/tag"
+)
+
+// XattrPrefix is the prefix of every extended attribute published on the
+// files in the mount. Raw tags are published as XattrPrefix+"raw."+name:
+//
+//	$ getfattr -d -m 'user.musefuse' 'artist/Miles Davis/So What.flac'
+//	user.musefuse.album="Kind of Blue"
+//	user.musefuse.raw.ALBUM="Kind of Blue"
+//	...
+const XattrPrefix = "user.musefuse."
+
+type xattr struct {
+	name  string
+	value string
+}
+
+// entryXattrs returns the extended attributes for entry, sorted by name.
+// Empty values and zero numbers are left out.
+func entryXattrs(entry *FileEntry) []xattr {
+	var attrs []xattr
+	add := func(name, value string) {
+		if value != "" {
+			attrs = append(attrs, xattr{XattrPrefix + name, value})
+		}
+	}
+	addInt := func(name string, value int) {
+		if value > 0 {
+			add(name, strconv.Itoa(value))
+		}
+	}
+
+	add("source_path", entry.File.FullPath())
+	add("database", entry.File.Database)
+	add("error", entry.Err)
+
+	if meta := entry.Metadata; meta != nil {
+		add("title", meta.Title)
+		add("artist", meta.Artist)
+		add("album", meta.Album)
+		add("albumartist", meta.AlbumArtist)
+		add("composer", meta.Composer)
+		add("genre", meta.Genre)
+		add("comment", meta.Comment)
+		add("format", string(meta.Format))
+		add("filetype", string(meta.FileType))
+		addInt("year", meta.Year)
+		addInt("track", meta.Track)
+		addInt("tracks", meta.Tracks)
+		addInt("disc", meta.Disc)
+		addInt("discs", meta.Discs)
+
+		add("codec", meta.Codec)
+		if meta.Lossless {
+			add("lossless", "1")
+		}
+		if meta.Duration > 0 {
+			add("duration", strconv.FormatFloat(meta.Duration.Seconds(), 'f', 3, 64))
+		}
+		addInt("bitrate", meta.Bitrate)
+		addInt("samplerate", meta.SampleRate)
+		addInt("channels", meta.Channels)
+		addInt("bitspersample", meta.BitsPerSample)
+
+		addGain := func(scope string, rg *ReplayGain) {
+			if rg != nil {
+				add("replaygain_"+scope+"_gain", formatGain(rg.Gain))
+				if rg.Peak > 0 {
+					add("replaygain_"+scope+"_peak", strconv.FormatFloat(rg.Peak, 'f', 6, 64))
+				}
+			}
+		}
+		addGain("track", meta.TrackGain)
+		addGain("album", meta.AlbumGain)
+
+		mb := meta.MusicBrainz
+		add("musicbrainz_trackid", mb.Recording)
+		add("musicbrainz_releasetrackid", mb.Track)
+		add("musicbrainz_albumid", mb.Release)
+		add("musicbrainz_releasegroupid", mb.ReleaseGroup)
+		add("musicbrainz_artistid", strings.Join(mb.Artists, ";"))
+		add("musicbrainz_albumartistid", strings.Join(mb.AlbumArtists, ";"))
+
+		for key, value := range meta.Raw {
+			if s, ok := rawTagString(value); ok {
+				add("raw."+key, s)
+			}
+		}
+	}
+
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].name < attrs[j].name })
+	return attrs
+}
+
+// rawTagString formats a value from Metadata.Raw as a string. Binary values
+// like pictures are not formatted, and ok is false.
+func rawTagString(v interface{}) (s string, ok bool) {
+	switch v := v.(type) {
+	case nil, []byte, *tag.Picture:
+		return "", false
+	case string:
+		s = v
+	case *tag.Comm:
+		s = v.Text
+	case *tag.UFID:
+		s = string(v.Identifier)
+	case int, int64, uint64, float64, bool:
+		s = fmt.Sprint(v)
+	case map[string]interface{}:
+		// A *tag.Comm that has been through the Index:
+		text, ok := v["Text"].(string)
+		if !ok {
+			return "", false
+		}
+		s = text
+	default:
+		return "", false
+	}
+	return strings.TrimSpace(s), true
+}
+
+// Getxattr publishes XattrPrefix+"source_path" for directories in ViewSource
+// and ViewNoReplayGain.
+func (dir *dirNode) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	dir.lock.RLock()
+	source := dir.source
+	dir.lock.RUnlock()
+
+	if source == "" || req.Name != XattrPrefix+"source_path" {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(source)
+	return nil
+}
+
+func (dir *dirNode) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	dir.lock.RLock()
+	source := dir.source
+	dir.lock.RUnlock()
+
+	if source != "" {
+		resp.Append(XattrPrefix + "source_path")
+	}
+	return nil
+}
+
+func (file *fileNode) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if !strings.HasPrefix(req.Name, XattrPrefix) {
+		return fuse.ErrNoXattr
+	}
+	for _, attr := range entryXattrs(file.entry) {
+		if attr.name == req.Name {
+			resp.Xattr = []byte(attr.value)
+			return nil
+		}
+	}
+	return fuse.ErrNoXattr
+}
+
+func (file *fileNode) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	for _, attr := range entryXattrs(file.entry) {
+		resp.Append(attr.name)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package musefuse
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/dhowden/tag"
+)
+
+func TestFileNodeXattr(t *testing.T) {
+	ctx := context.Background()
+	entry := testEntry("a.flac", &Metadata{
+		Artist:   "Miles Davis",
+		Title:    "So What",
+		Year:     1959,
+		Codec:    CodecFLAC,
+		Duration: 125500 * time.Millisecond,
+		Raw: map[string]interface{}{
+			"TXXX":    &tag.Comm{Description: "foo", Text: "bar"},
+			"APIC":    &tag.Picture{Data: []byte{1, 2, 3}},
+			"comment": map[string]interface{}{"Text": "yep"},
+		},
+	})
+	file := newFileNode(nil, 1, "a.flac", entry)
+
+	var list fuse.ListxattrResponse
+	if err := file.Listxattr(ctx, &fuse.ListxattrRequest{}, &list); err != nil {
+		t.Fatal(err)
+	}
+	names := strings.Split(strings.TrimSuffix(string(list.Xattr), "\x00"), "\x00")
+	expected := []string{"artist", "codec", "duration", "raw.TXXX", "raw.comment", "source_path", "title", "year"}
+	if len(names) != len(expected) {
+		t.Fatal("unexpected xattrs", names)
+	}
+	for i, name := range expected {
+		if names[i] != XattrPrefix+name {
+			t.Fatal("unexpected xattrs", names)
+		}
+	}
+
+	for name, value := range map[string]string{
+		"artist":      "Miles Davis",
+		"year":        "1959",
+		"source_path": "/music/a.flac",
+		"raw.TXXX":    "bar",
+		"duration":    "125.500",
+	} {
+		var resp fuse.GetxattrResponse
+		if err := file.Getxattr(ctx, &fuse.GetxattrRequest{Name: XattrPrefix + name}, &resp); err != nil {
+			t.Fatal(name, err)
+		}
+		if string(resp.Xattr) != value {
+			t.Fatalf("%s: expected %q, found %q", name, value, resp.Xattr)
+		}
+	}
+
+	var resp fuse.GetxattrResponse
+	if err := file.Getxattr(ctx, &fuse.GetxattrRequest{Name: XattrPrefix + "album"}, &resp); err != fuse.ErrNoXattr {
+		t.Fatal("expected ErrNoXattr, found", err)
+	}
+}